@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// validateAfter checks the watches named in after exist and don't depend on
+// each other in a cycle
+func validateAfter(watches []WatchConfig) error {
+	byName := map[string]WatchConfig{}
+	for _, w := range watches {
+		if w.Name != "" {
+			byName[w.Name] = w
+		}
+	}
+
+	for _, w := range watches {
+		for _, name := range w.After {
+			if _, ok := byName[name]; !ok {
+				return fmt.Errorf("watch %s: after refers to unknown watch %q", w.Name, name)
+			}
+			if name == w.Name {
+				return fmt.Errorf("watch %s: after refers to itself", w.Name)
+			}
+		}
+	}
+
+	// a watch can't come after a watch that comes after it
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if slices.Contains(path, name) {
+			return fmt.Errorf("after forms a cycle: %s", strings.Join(append(path, name), " -> "))
+		}
+		for _, next := range byName[name].After {
+			if err := visit(next, append(path, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, w := range watches {
+		if w.Name == "" {
+			continue
+		}
+		if err := visit(w.Name, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// linkWatches makes the steps generated for each watch with after depend on
+// the steps generated for the watches it names, which are given keys when
+// they have none. Dependencies on watches that generated no steps are
+// dropped. generated holds the steps of each watch by index. The keys
+// given are marked so dedupSteps can tell them from configured ones.
+func linkWatches(generated [][]generatedStep, watches []WatchConfig) {
+	keys := map[string][]string{}
+	for i, w := range watches {
+		if w.Name == "" || !isReferenced(w.Name, watches) {
+			continue
+		}
+
+		for j := range generated[i] {
+			step := &generated[i][j].Step
+			if step.Wait != nil {
+				continue
+			}
+			if step.Key == "" {
+				step.Key = watchStepKey(w.Name, len(keys[w.Name])+1)
+				generated[i][j].AutoKey = true
+			}
+			keys[w.Name] = append(keys[w.Name], step.Key)
+		}
+	}
+
+	for i, w := range watches {
+		dependencies := []string{}
+		for _, name := range w.After {
+			if len(keys[name]) == 0 {
+				log.WithFields(log.Fields{"phase": phaseGenerate, "watch": w.Name}).Debugf("watch %s: %s generated no steps, dropping the dependency on it", w.Name, name)
+				continue
+			}
+			dependencies = append(dependencies, keys[name]...)
+		}
+
+		if len(dependencies) == 0 {
+			continue
+		}
+
+		for j := range generated[i] {
+			step := &generated[i][j].Step
+			if step.Wait == nil {
+				step.DependsOn = addDependencies(step.DependsOn, dependencies)
+			}
+		}
+	}
+}
+
+// isReferenced reports whether any watch comes after the watch called name
+func isReferenced(name string, watches []WatchConfig) bool {
+	for _, w := range watches {
+		if slices.Contains(w.After, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watchStepKey returns the key generated for the nth step of a watch
+func watchStepKey(name string, n int) string {
+	return strings.Trim(invalidKeyChars.ReplaceAllString(name, "-"), "-") + "-" + strconv.Itoa(n)
+}
+
+// addDependencies returns depends_on with keys added, leaving it untouched
+func addDependencies(dependsOn interface{}, keys []string) interface{} {
+	more := make([]interface{}, len(keys))
+	for i, key := range keys {
+		more[i] = key
+	}
+
+	return appendDependsOn(dependsOn, more)
+}
+
+// renameDependencies returns a copy of step with the depends_on entries of
+// it and its nested steps that refer to a key of renamed referring to the
+// key it maps to instead
+func renameDependencies(step Step, renamed map[string]string) Step {
+	if step.DependsOn != nil {
+		list := []interface{}{}
+		changed := false
+		for _, d := range dependsOnList(step.DependsOn) {
+			if key, ok := renamed[dependencyKey(d)]; ok {
+				changed = true
+				if m, ok := d.(map[string]interface{}); ok {
+					entry := make(map[string]interface{}, len(m))
+					for k, v := range m {
+						entry[k] = v
+					}
+					entry["step"] = key
+					d = entry
+				} else {
+					d = key
+				}
+			}
+			list = appendDependsOn(list, []interface{}{d})
+		}
+		if changed {
+			step.DependsOn = list
+		}
+	}
+
+	if step.Steps != nil {
+		nested := make([]Step, len(step.Steps))
+		for i, n := range step.Steps {
+			nested[i] = renameDependencies(n, renamed)
+		}
+		step.Steps = nested
+	}
+
+	return step
+}
+
+// appendDependsOn returns the depends_on entries of dependsOn followed by
+// those of more it doesn't already contain, leaving both untouched
+func appendDependsOn(dependsOn interface{}, more []interface{}) []interface{} {
+	list := dependsOnList(dependsOn)
+	for _, d := range more {
+		if !slices.ContainsFunc(list, func(e interface{}) bool { return reflect.DeepEqual(e, d) }) {
+			list = append(list, d)
+		}
+	}
+
+	return list
+}
+
+// dependsOnList returns a copy of the entries of a depends_on value
+func dependsOnList(dependsOn interface{}) []interface{} {
+	switch d := dependsOn.(type) {
+	case nil:
+		return []interface{}{}
+	case []interface{}:
+		return append([]interface{}{}, d...)
+	default:
+		return []interface{}{d}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAfter(t *testing.T) {
+	assert.NoError(t, validateAfter([]WatchConfig{{Name: "build"}, {Name: "deploy", After: []string{"build"}}, {}}))
+
+	err := validateAfter([]WatchConfig{{Name: "deploy", After: []string{"build"}}})
+	assert.EqualError(t, err, `watch deploy: after refers to unknown watch "build"`)
+
+	err = validateAfter([]WatchConfig{{Name: "deploy", After: []string{"deploy"}}})
+	assert.EqualError(t, err, "watch deploy: after refers to itself")
+
+	err = validateAfter([]WatchConfig{
+		{Name: "a", After: []string{"c"}},
+		{Name: "b", After: []string{"a"}},
+		{Name: "c", After: []string{"b"}},
+	})
+	assert.EqualError(t, err, "after forms a cycle: a -> c -> b -> a")
+}
+
+func TestAddDependencies(t *testing.T) {
+	assert.Equal(t, []interface{}{"lint", "build-1"}, addDependencies("lint", []string{"build-1"}))
+	assert.Equal(t, []interface{}{"build-1"}, addDependencies(nil, []string{"build-1"}))
+
+	existing := []interface{}{"lint", map[string]interface{}{"step": "test"}, "build-1"}
+	got := addDependencies(existing, []string{"build-1", "build-2"})
+	assert.Equal(t, []interface{}{"lint", map[string]interface{}{"step": "test"}, "build-1", "build-2"}, got)
+	assert.Len(t, existing, 3)
+}
+
+func TestStepsToTriggerWithAfter(t *testing.T) {
+	plugin := Plugin{
+		Watch: []WatchConfig{
+			{
+				Name:  "deploy",
+				Paths: []string{"deploy/"},
+				After: []string{"build", "lib"},
+				Steps: []Step{{Trigger: "deploy", DependsOn: "approve"}},
+			},
+			{
+				Name:  "build",
+				Paths: []string{"api/"},
+				Steps: []Step{
+					{Command: "make api", Key: "api"},
+					{Wait: &WaitStep{}},
+					{Command: "make api-docs"},
+				},
+			},
+			{Name: "lib", Paths: []string{"lib/"}, Steps: []Step{{Command: "make lib"}}},
+		},
+	}
+
+	steps, err := stepsToTrigger([]string{"deploy/app.yml", "api/main.go"}, plugin)
+	require.NoError(t, err)
+	require.Len(t, steps, 4)
+
+	// lib didn't match, so the dependency on it is dropped
+	assert.Equal(t, []interface{}{"approve", "api", "build-2"}, steps[0].DependsOn)
+	assert.Equal(t, "api", steps[1].Key)
+	assert.Equal(t, "build-2", steps[3].Key)
+	assert.Equal(t, "", plugin.Watch[1].Steps[2].Key)
+
+	// without the watches it comes after, the step is unchanged
+	steps, err = stepsToTrigger([]string{"deploy/app.yml"}, plugin)
+	require.NoError(t, err)
+	assert.Equal(t, []Step{{Trigger: "deploy", DependsOn: "approve"}}, steps)
+
+	// keys are generated whether or not the watches after them match, so
+	// they stay the same from build to build
+	steps, err = stepsToTrigger([]string{"api/main.go"}, plugin)
+	require.NoError(t, err)
+	assert.Equal(t, "build-2", steps[2].Key)
+}
+
+func TestStepsToTriggerWithAfterMergesDuplicates(t *testing.T) {
+	plugin := Plugin{
+		Watch: []WatchConfig{
+			{Name: "web", Paths: []string{"web/"}, Steps: []Step{{Trigger: "deploy"}}},
+			{Name: "api", Paths: []string{"api/"}, Steps: []Step{{Trigger: "deploy"}}},
+			{Name: "lib", Paths: []string{"lib/"}, Steps: []Step{{Trigger: "deploy"}}},
+			{Name: "smoke", Paths: []string{"smoke/"}, After: []string{"api", "lib"}, Steps: []Step{{Command: "make smoke"}}},
+		},
+	}
+
+	steps, err := stepsToTrigger([]string{"web/a.ts", "api/a.go", "lib/b.go", "smoke/run.sh"}, plugin)
+	require.NoError(t, err)
+
+	// the steps of api and lib are merged into the one from web, which
+	// takes the key smoke depends on
+	assert.Equal(t, []Step{
+		{Trigger: "deploy", Key: "api-1"},
+		{Command: "make smoke", DependsOn: []interface{}{"api-1"}},
+	}, steps)
+}
+
+func TestStepsToTriggerWithAfterAndGroupBy(t *testing.T) {
+	plugin := Plugin{
+		GroupBy: groupByWatch,
+		Watch: []WatchConfig{
+			{Name: "api", Paths: []string{"api/"}, Steps: []Step{{Command: "make api"}, {Command: "make api-docs"}}},
+			{Name: "deploy", Paths: []string{"deploy/"}, After: []string{"api"}, Key: "deploy", Steps: []Step{{Group: "Deploy", Steps: []Step{{Trigger: "deploy"}}}}},
+		},
+	}
+
+	steps, err := stepsToTrigger([]string{"api/main.go", "deploy/app.yml"}, plugin)
+	require.NoError(t, err)
+
+	// the groups themselves are linked
+	assert.Equal(t, []Step{
+		{Group: "api", Key: "api-1", Steps: []Step{{Command: "make api"}, {Command: "make api-docs"}}},
+		{Group: "Deploy", Key: "deploy", DependsOn: []interface{}{"api-1"}, Steps: []Step{{Trigger: "deploy"}}},
+	}, steps)
+}
+
+func TestPluginWithAfter(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{ "name": "build", "path": "api/", "config": { "command": "make" } },
+				{ "name": "deploy", "path": "deploy/", "after": "build", "config": { "trigger": "deploy" } },
+				{ "path": "docs/", "after": ["build", "deploy"], "config": { "command": "make docs" } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"build"}, got.Watch[1].After)
+	assert.Equal(t, []string{"build", "deploy"}, got.Watch[2].After)
+	assert.Nil(t, got.Watch[2].RawAfter)
+}
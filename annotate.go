@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Annotation defaults
+const (
+	defaultAnnotationStyle   = "info"
+	defaultAnnotationContext = "monorepo-diff"
+)
+
+// annotationStyles are the styles Buildkite annotations support
+var annotationStyles = []string{"success", "info", "warning", "error"}
+
+// Annotation configures the build annotation summarising the diff
+type Annotation struct {
+	Style   string `json:"style"`
+	Context string `json:"context"`
+}
+
+// summary records what the changed files generated and why
+type summary struct {
+	DiffBase string
+	Files    []string
+	// Watches holds the result of each watch by index
+	Watches []watchResult
+	Steps   []Step
+	// Invalid are the generated steps dropped as invalid
+	Invalid []invalidStep
+}
+
+// watchResult is whether a watch generated steps, and why
+type watchResult struct {
+	Name    string
+	Matched bool
+	Reason  string
+}
+
+// invalidStep is a generated step dropped as invalid
+type invalidStep struct {
+	Watches []string
+	Reason  string
+}
+
+// annotate adds the summary to the build as an annotation. Failing to is
+// logged rather than failing the upload.
+func annotate(s summary, a Annotation) {
+	args := []string{"annotate", "--style", a.Style, "--context", a.Context, s.markdown()}
+
+	if _, err := executeCommand("buildkite-agent", args); err != nil {
+		log.WithField("phase", phaseUpload).Warnf("Failed to annotate the build: %v", err)
+	}
+}
+
+// markdown returns the summary as the markdown of an annotation
+func (s summary) markdown() string {
+	var b strings.Builder
+
+	b.WriteString("#### monorepo-diff\n\n")
+	if s.DiffBase != "" {
+		fmt.Fprintf(&b, "%d changed files compared to `%s`.\n\n", len(s.Files), s.DiffBase)
+	} else {
+		fmt.Fprintf(&b, "%d changed files.\n\n", len(s.Files))
+	}
+
+	if len(s.Watches) > 0 {
+		b.WriteString("| Watch | Status | Reason |\n| --- | --- | --- |\n")
+		for _, w := range s.Watches {
+			status := "skipped"
+			if w.Matched {
+				status = "matched"
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", markdownCell(w.Name), status, markdownCell(w.Reason))
+		}
+		b.WriteString("\n")
+	}
+
+	if len(s.Steps) == 0 {
+		b.WriteString("No steps generated.\n")
+	} else {
+		b.WriteString("Generated steps:\n\n")
+		for _, step := range s.Steps {
+			fmt.Fprintf(&b, "* %s\n", describeStep(step))
+		}
+	}
+
+	if len(s.Invalid) > 0 {
+		b.WriteString("\nInvalid steps dropped:\n\n")
+		for _, i := range s.Invalid {
+			fmt.Fprintf(&b, "* %s: %s\n", describeWatches(i.Watches), i.Reason)
+		}
+	}
+
+	return b.String()
+}
+
+// describeStep returns a short markdown description of a step
+func describeStep(step Step) string {
+	switch {
+	case step.Wait != nil:
+		return "wait"
+	case step.Trigger != "":
+		return fmt.Sprintf("trigger `%s`", step.Trigger)
+	case step.Group != "":
+		return fmt.Sprintf("group %s with %d steps", step.Group, len(step.Steps))
+	case step.Label != "":
+		return step.Label
+	case step.Block != "":
+		return fmt.Sprintf("block %s", step.Block)
+	case step.Input != "":
+		return fmt.Sprintf("input %s", step.Input)
+	case step.Command != nil:
+		return commandText(step.Command)
+	case step.Commands != nil:
+		return commandText(step.Commands)
+	case step.Key != "":
+		return step.Key
+	default:
+		return "step"
+	}
+}
+
+// commandText returns a command, or a list of commands, as markdown code
+func commandText(command interface{}) string {
+	list, ok := command.([]interface{})
+	if !ok {
+		return fmt.Sprintf("`%v`", command)
+	}
+
+	commands := make([]string, len(list))
+	for i, c := range list {
+		commands[i] = fmt.Sprintf("`%v`", c)
+	}
+
+	return strings.Join(commands, ", ")
+}
+
+// markdownCell escapes the pipes of a markdown table cell
+func markdownCell(s string) string {
+	return strings.ReplaceAll(s, "|", "\\|")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarize(t *testing.T) {
+	plugin := Plugin{
+		DiffBase: "abc123",
+		Watch: []WatchConfig{
+			{Name: "api", Paths: []string{"services/api/"}, Steps: []Step{{Label: "API", Command: "make api"}}},
+			{Name: "web", Paths: []string{"services/web/"}, Steps: []Step{{Trigger: "web"}}},
+			{Name: "docs", Paths: []string{"docs/"}, ExceptPaths: []string{"docs/VERSION"}, Steps: []Step{{Command: "make docs"}}},
+			{Name: "lib", Paths: []string{"lib/"}, Steps: []Step{{Label: "nothing"}}},
+			{Name: "default", Default: true, Steps: []Step{{Command: "make all"}}},
+		},
+	}
+
+	got, err := summarize([]string{"services/api/main.go", "docs/VERSION", "lib/a.go"}, plugin)
+	require.NoError(t, err)
+
+	assert.Equal(t, []watchResult{
+		{Name: "api", Matched: true, Reason: "1 of 3 changed files matched"},
+		{Name: "web", Reason: "no changed files matched"},
+		{Name: "docs", Reason: "excepted: docs/VERSION"},
+		{Name: "lib", Matched: true, Reason: "1 of 3 changed files matched"},
+		{Name: "default", Reason: "other watches generated steps"},
+	}, got.Watches)
+	assert.Equal(t, []Step{{Label: "API", Command: "make api"}}, got.Steps)
+	assert.Equal(t, []invalidStep{{Watches: []string{"lib"}, Reason: "step with label 'nothing' has no command, trigger, block, input, or group"}}, got.Invalid)
+
+	want := "#### monorepo-diff\n\n" +
+		"3 changed files compared to `abc123`.\n\n" +
+		"| Watch | Status | Reason |\n" +
+		"| --- | --- | --- |\n" +
+		"| api | matched | 1 of 3 changed files matched |\n" +
+		"| web | skipped | no changed files matched |\n" +
+		"| docs | skipped | excepted: docs/VERSION |\n" +
+		"| lib | matched | 1 of 3 changed files matched |\n" +
+		"| default | skipped | other watches generated steps |\n\n" +
+		"Generated steps:\n\n" +
+		"* API\n\n" +
+		"Invalid steps dropped:\n\n" +
+		"* watch lib: step with label 'nothing' has no command, trigger, block, input, or group\n"
+	assert.Equal(t, want, got.markdown())
+}
+
+func TestSummaryMarkdownWithoutSteps(t *testing.T) {
+	s := summary{Files: []string{"README.md"}, Watches: []watchResult{{Name: "api", Reason: "no changed files matched"}}}
+
+	want := "#### monorepo-diff\n\n" +
+		"1 changed files.\n\n" +
+		"| Watch | Status | Reason |\n" +
+		"| --- | --- | --- |\n" +
+		"| api | skipped | no changed files matched |\n\n" +
+		"No steps generated.\n"
+	assert.Equal(t, want, s.markdown())
+}
+
+func TestDescribeStep(t *testing.T) {
+	assert.Equal(t, "wait", describeStep(Step{Wait: &WaitStep{}}))
+	assert.Equal(t, "trigger `deploy`", describeStep(Step{Trigger: "deploy", Label: "Deploy"}))
+	assert.Equal(t, "group API with 2 steps", describeStep(Step{Group: "API", Steps: []Step{{}, {}}}))
+	assert.Equal(t, "`make test`, `make lint`", describeStep(Step{Commands: []interface{}{"make test", "make lint"}}))
+	assert.Equal(t, "`make`", describeStep(Step{Command: "make"}))
+}
+
+func TestUploadPipelineAnnotates(t *testing.T) {
+	plugin := Plugin{
+		Diff:     "echo services/api/main.go",
+		Annotate: &Annotation{Style: "warning", Context: "monorepo"},
+		Watch:    []WatchConfig{{Name: "api", Paths: []string{"services/api/"}, Steps: []Step{{Command: "make api"}}}},
+	}
+
+	agent, err := bintest.NewMock("buildkite-agent")
+	require.NoError(t, err)
+
+	oldPath := os.Getenv("PATH")
+	t.Cleanup(func() { _ = os.Setenv("PATH", oldPath) })
+	_ = os.Setenv("PATH", filepath.Dir(agent.Path)+":"+oldPath)
+
+	body := "#### monorepo-diff\n\n" +
+		"1 changed files.\n\n" +
+		"| Watch | Status | Reason |\n" +
+		"| --- | --- | --- |\n" +
+		"| api | matched | 1 of 1 changed files matched |\n\n" +
+		"Generated steps:\n\n" +
+		"* `make api`\n"
+	agent.
+		Expect("annotate", "--style", "warning", "--context", "monorepo", body).
+		AndExitWith(0)
+
+	err = uploadPipeline(plugin, generatePipeline, &recordingUploader{})
+	assert.NoError(t, err)
+
+	require.NoError(t, agent.CheckAndClose(t))
+}
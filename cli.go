@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runCommand runs a subcommand of the binary. Subcommands help debug a
+// plugin config locally, without a Buildkite agent.
+func runCommand(args []string, out io.Writer) error {
+	switch args[0] {
+	case "explain":
+		return explainCommand(args[1:], out)
+	case "validate":
+		return validateCommand(args[1:], out)
+	case "run":
+		return runPipelineCommand(args[1:], out)
+	}
+
+	return fmt.Errorf("unknown command %q, expected explain, validate or run", args[0])
+}
+
+// loadConfig reads the plugin config from a pipeline file using the plugin,
+// or a file holding just the plugin config. step selects the plugin step of
+// the pipeline by label or key, the first one being used when it's empty.
+func loadConfig(path, step string) (Plugin, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Plugin{}, fmt.Errorf("could not read config: %v", err)
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return Plugin{}, fmt.Errorf("could not parse config %s: %v", path, err)
+	}
+
+	configs := pluginConfigs(doc, step)
+	if len(configs) == 0 && step != "" {
+		return Plugin{}, fmt.Errorf("no step %q using the %s plugin found in %s", step, pluginName, path)
+	}
+	if len(configs) == 0 {
+		return Plugin{}, fmt.Errorf("no %s plugin config found in %s", pluginName, path)
+	}
+
+	b, err := json.Marshal(configs)
+	if err != nil {
+		return Plugin{}, fmt.Errorf("could not parse config %s: %v", path, err)
+	}
+
+	plugin, err := initializePlugin(string(b))
+
+	return plugin, withExitCode(exitConfig, err)
+}
+
+// pluginConfigs returns the configs of the plugin in a pipeline, keyed by
+// plugin reference as in BUILDKITE_PLUGINS, of the steps with step as label
+// or key when it's set. A document with a watch list is taken to be the
+// plugin config itself.
+func pluginConfigs(doc interface{}, step string) []map[string]interface{} {
+	if m, ok := doc.(map[string]interface{}); ok {
+		if _, ok := m["watch"]; ok {
+			return []map[string]interface{}{{pluginName: m}}
+		}
+		doc = m["steps"]
+	}
+
+	configs := []map[string]interface{}{}
+
+	steps, _ := doc.([]interface{})
+	for _, item := range steps {
+		s, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		var plugins []interface{}
+		switch p := s["plugins"].(type) {
+		case []interface{}:
+			plugins = p
+		case map[string]interface{}:
+			for name, config := range p {
+				plugins = append(plugins, map[string]interface{}{name: config})
+			}
+		}
+		if step != "" && !isStep(s, step) {
+			plugins = nil
+		}
+
+		for _, p := range plugins {
+			plugin, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for name, config := range plugin {
+				if strings.HasPrefix(getPluginName(name), pluginName) {
+					configs = append(configs, map[string]interface{}{name: config})
+				}
+			}
+		}
+
+		// group steps hold their own steps
+		configs = append(configs, pluginConfigs(map[string]interface{}{"steps": s["steps"]}, step)...)
+	}
+
+	return configs
+}
+
+// isStep reports whether a pipeline step has name as its label or key
+func isStep(s map[string]interface{}, name string) bool {
+	for _, field := range []string{"label", "name", "key", "id"} {
+		if v, ok := s[field].(string); ok && v == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readFiles reads a list of changed files, in the format of the diff
+// command output, from path or from stdin when path is "-"
+func readFiles(path string) ([]string, error) {
+	if path == "" {
+		return nil, errors.New("no changed files given")
+	}
+
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read changed files: %v", err)
+	}
+
+	return parseDiffOutput(string(data)), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import "strings"
+
+// Env vars and meta-data keys describing why a build was triggered
+const (
+	sourceBuildURLEnv    = "MONOREPO_DIFF_SOURCE_BUILD_URL"
+	sourceBuildNumberEnv = "MONOREPO_DIFF_SOURCE_BUILD_NUMBER"
+	sourceBuildIDEnv     = "MONOREPO_DIFF_SOURCE_BUILD_ID"
+	diffBaseEnv          = "MONOREPO_DIFF_BASE"
+	watchEnv             = "MONOREPO_DIFF_WATCH"
+
+	metadataPrefix = "monorepo-diff-"
+)
+
+// triggerContext is the change context attached to triggered builds
+type triggerContext struct {
+	// Watches are the names of the watches that generated the step
+	Watches []string
+	// Files are the changed files that matched those watches
+	Files []string
+	// DiffBase is the commit the diff was taken against, if known
+	DiffBase string
+	// Interpolation escapes the values for the pipeline upload when set
+	Interpolation bool
+}
+
+// values returns the context values keyed by env var, leaving out unknown ones
+func (c triggerContext) values() map[string]string {
+	values := map[string]string{
+		sourceBuildURLEnv:    env("BUILDKITE_BUILD_URL", ""),
+		sourceBuildNumberEnv: env("BUILDKITE_BUILD_NUMBER", ""),
+		sourceBuildIDEnv:     env("BUILDKITE_BUILD_ID", ""),
+		diffBaseEnv:          c.DiffBase,
+		watchEnv:             strings.Join(c.Watches, "\n"),
+	}
+
+	for k, v := range values {
+		if v == "" {
+			delete(values, k)
+		} else if c.Interpolation {
+			values[k] = escapeInterpolation(v)
+		}
+	}
+
+	return values
+}
+
+// metadataKey returns the meta-data key for a context env var, e.g.
+// "monorepo-diff-source-build-url" for MONOREPO_DIFF_SOURCE_BUILD_URL
+func metadataKey(envName string) string {
+	name := strings.TrimPrefix(envName, "MONOREPO_DIFF_")
+	return metadataPrefix + strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+// withTriggerContext returns a copy of step with the change context in the
+// build env and meta-data of every trigger step it contains. Values set in
+// the step config are kept.
+func withTriggerContext(step Step, c triggerContext) Step {
+	if step.Trigger != "" {
+		for k, v := range c.values() {
+			step.Build.Env = withEnv(step.Build.Env, k, v)
+			step.Build.Metadata = withEnv(step.Build.Metadata, metadataKey(k), v)
+		}
+		if _, ok := step.Build.Env[matchedFilesEnv]; !ok {
+			step.Build.Env = withEnv(step.Build.Env, matchedFilesEnv, strings.Join(c.Files, "\n"))
+			step.MatchedFiles = true
+		}
+	}
+
+	if step.Steps != nil {
+		nested := make([]Step, len(step.Steps))
+		for i, n := range step.Steps {
+			nested[i] = withTriggerContext(n, c)
+		}
+		step.Steps = nested
+	}
+
+	return step
+}
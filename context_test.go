@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataKey(t *testing.T) {
+	assert.Equal(t, "monorepo-diff-source-build-url", metadataKey(sourceBuildURLEnv))
+	assert.Equal(t, "monorepo-diff-base", metadataKey(diffBaseEnv))
+	assert.Equal(t, "monorepo-diff-watch", metadataKey(watchEnv))
+}
+
+func TestWithTriggerContext(t *testing.T) {
+	t.Setenv("BUILDKITE_BUILD_URL", "https://buildkite.com/acme/monorepo/builds/42")
+	t.Setenv("BUILDKITE_BUILD_NUMBER", "42")
+	t.Setenv("BUILDKITE_BUILD_ID", "0190b4b2-9c3e-4d4c-8a5e-2f9d6c1e7a10")
+
+	c := triggerContext{
+		Watches:  []string{"api", "lib"},
+		Files:    []string{"api/a.go", "lib/b.go"},
+		DiffBase: "abc123",
+	}
+
+	trigger := withTriggerContext(Step{Trigger: "deploy", Build: Build{Env: map[string]string{watchEnv: "custom"}}}, c)
+	assert.Equal(t, map[string]string{
+		sourceBuildURLEnv:    "https://buildkite.com/acme/monorepo/builds/42",
+		sourceBuildNumberEnv: "42",
+		sourceBuildIDEnv:     "0190b4b2-9c3e-4d4c-8a5e-2f9d6c1e7a10",
+		diffBaseEnv:          "abc123",
+		watchEnv:             "custom",
+		matchedFilesEnv:      "api/a.go\nlib/b.go",
+	}, trigger.Build.Env)
+	assert.Equal(t, map[string]string{
+		"monorepo-diff-source-build-url":    "https://buildkite.com/acme/monorepo/builds/42",
+		"monorepo-diff-source-build-number": "42",
+		"monorepo-diff-source-build-id":     "0190b4b2-9c3e-4d4c-8a5e-2f9d6c1e7a10",
+		"monorepo-diff-base":                "abc123",
+		"monorepo-diff-watch":               "api\nlib",
+	}, trigger.Build.Metadata)
+
+	command := withTriggerContext(Step{Command: "lint"}, c)
+	assert.Nil(t, command.Env)
+	assert.Nil(t, command.Build.Env)
+
+	group := withTriggerContext(Step{Group: "deploys", Steps: []Step{{Command: "lint"}, {Trigger: "deploy"}}}, c)
+	assert.Nil(t, group.Steps[0].Env)
+	assert.Equal(t, "42", group.Steps[1].Build.Env[sourceBuildNumberEnv])
+}
+
+func TestWithTriggerContextLeavesOutUnknownValues(t *testing.T) {
+	t.Setenv("BUILDKITE_BUILD_URL", "")
+	t.Setenv("BUILDKITE_BUILD_NUMBER", "")
+	t.Setenv("BUILDKITE_BUILD_ID", "")
+
+	step := withTriggerContext(Step{Trigger: "deploy"}, triggerContext{Watches: []string{"$api"}, Interpolation: true})
+	assert.Equal(t, map[string]string{watchEnv: "$$api", matchedFilesEnv: ""}, step.Build.Env)
+	assert.Equal(t, map[string]string{"monorepo-diff-watch": "$$api"}, step.Build.Metadata)
+}
+
+func TestStepsToTriggerAttachesTriggerContext(t *testing.T) {
+	t.Setenv("BUILDKITE_BUILD_NUMBER", "42")
+
+	plugin := Plugin{
+		TriggerContext: true,
+		DiffBase:       "abc123",
+		Watch: []WatchConfig{
+			{Name: "api", Paths: []string{"api/"}, Steps: []Step{{Trigger: "deploy"}}},
+			{Name: "lib", Paths: []string{"lib/"}, Steps: []Step{{Trigger: "deploy"}}},
+			{Name: "web", Paths: []string{"web/"}, Steps: []Step{{Command: "lint"}}},
+			{Name: "fallback", Default: true, Steps: []Step{{Trigger: "everything"}}},
+		},
+	}
+
+	steps, err := stepsToTrigger([]string{"api/a.go", "lib/b.go", "web/c.ts"}, plugin)
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+
+	// identical steps from different watches are merged with both names
+	assert.Equal(t, "api\nlib", steps[0].Build.Env[watchEnv])
+	assert.Equal(t, "api/a.go\nlib/b.go", steps[0].Build.Env[matchedFilesEnv])
+	assert.Equal(t, "abc123", steps[0].Build.Metadata["monorepo-diff-base"])
+	assert.Equal(t, "42", steps[0].Build.Metadata["monorepo-diff-source-build-number"])
+	assert.True(t, steps[0].MatchedFiles)
+	assert.Nil(t, steps[1].Env)
+
+	steps, err = stepsToTrigger([]string{"docs/d.md"}, plugin)
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	assert.Equal(t, "fallback", steps[0].Build.Env[watchEnv])
+	assert.Equal(t, "docs/d.md", steps[0].Build.Env[matchedFilesEnv])
+}
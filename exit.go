@@ -0,0 +1,49 @@
+package main
+
+import "errors"
+
+// Exit codes of the binary, one per class of failure
+const (
+	exitFailure   = 1 // any other failure
+	exitConfig    = 2 // the plugin config is invalid
+	exitDiff      = 3 // the diff command failed
+	exitGenerate  = 4 // generating the pipeline failed
+	exitUpload    = 5 // uploading the pipeline, artifacts or meta-data failed
+	exitNoMatch   = 6 // fail_on_no_match is set and no steps were generated
+	exitUncovered = 7 // fail_on_uncovered is set and changed files are not covered
+)
+
+// exitError is an error exiting the binary with a given code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode returns err exiting with code, keeping the code err already
+// has if any. It returns nil when err is nil.
+func withExitCode(code int, err error) error {
+	var e *exitError
+	if err == nil || errors.As(err, &e) {
+		return err
+	}
+
+	return &exitError{code: code, err: err}
+}
+
+// exitCode returns the code the binary exits with for err
+func exitCode(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+
+	return exitFailure
+}
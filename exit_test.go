@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, exitFailure, exitCode(errors.New("failed")))
+	assert.Equal(t, exitDiff, exitCode(withExitCode(exitDiff, errors.New("failed"))))
+
+	// the first code given is kept
+	err := withExitCode(exitGenerate, withExitCode(exitUncovered, errors.New("uncovered")))
+	assert.Equal(t, exitUncovered, exitCode(err))
+	assert.EqualError(t, err, "uncovered")
+
+	assert.Equal(t, exitUpload, exitCode(fmt.Errorf("wrapped: %w", withExitCode(exitUpload, errors.New("failed")))))
+	assert.NoError(t, withExitCode(exitConfig, nil))
+}
+
+func TestUploadPipelineExitCodes(t *testing.T) {
+	watch := []WatchConfig{{Name: "api", Paths: []string{"services/api/"}, Steps: []Step{{Command: "make api"}}}}
+
+	tests := map[string]struct {
+		plugin Plugin
+		code   int
+		err    string
+	}{
+		"diff fails": {
+			plugin: Plugin{Diff: "false", Watch: watch},
+			code:   exitDiff,
+		},
+		"no match": {
+			plugin: Plugin{Diff: "echo README.md", FailOnNoMatch: true, Watch: watch},
+			code:   exitNoMatch,
+			err:    "no steps generated for 1 changed files",
+		},
+		"uncovered": {
+			plugin: Plugin{Diff: "echo README.md", FailOnUncovered: true, Watch: watch},
+			code:   exitUncovered,
+			err:    "1 changed files are not covered by any watch:\nREADME.md",
+		},
+		"template fails": {
+			plugin: Plugin{Diff: "echo services/api/main.go", Templates: true, Watch: []WatchConfig{{Name: "api", Paths: []string{"services/api/"}, Steps: []Step{{Command: "{{ .Missing"}}}}},
+			code:   exitGenerate,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := uploadPipeline(tc.plugin, generatePipeline, &recordingUploader{})
+			assert.Error(t, err)
+			assert.Equal(t, tc.code, exitCode(err))
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestUploadPipelineFailOnNoMatchWithSteps(t *testing.T) {
+	plugin := Plugin{
+		Diff:          "echo services/api/main.go",
+		FailOnNoMatch: true,
+		Watch:         []WatchConfig{{Name: "api", Paths: []string{"services/api/"}, Steps: []Step{{Command: "make api"}}}},
+	}
+
+	uploader := &recordingUploader{}
+	assert.NoError(t, uploadPipeline(plugin, generatePipeline, uploader))
+	assert.Len(t, uploader.pipelines, 1)
+}
+
+func TestUploadPipelineUploadFails(t *testing.T) {
+	plugin := Plugin{
+		Diff:  "echo services/api/main.go",
+		Watch: []WatchConfig{{Name: "api", Paths: []string{"services/api/"}, Steps: []Step{{Command: "make api"}}}},
+	}
+
+	err := uploadPipeline(plugin, generatePipeline, failingUploader{})
+	assert.Equal(t, exitUpload, exitCode(err))
+}
+
+// failingUploader fails every upload
+type failingUploader struct{}
+
+func (failingUploader) Upload(pipeline string) error {
+	return errors.New("upload failed")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// fileMatch is a changed file and the watch pattern it matched
+type fileMatch struct {
+	File    string
+	Pattern string
+}
+
+// watchExplanation describes how the changed files matched a watch
+type watchExplanation struct {
+	Watch WatchConfig
+	// Matched are the files matching a path and no skip path
+	Matched []fileMatch
+	// Skipped are the files matching a path removed by a skip path
+	Skipped []fileMatch
+	// Excepted is the changed file and except path excluding the whole
+	// watch, if any
+	Excepted *fileMatch
+}
+
+// explainWatch returns how files matched the paths of w
+func explainWatch(w WatchConfig, files []string) (watchExplanation, error) {
+	e := watchExplanation{Watch: w, Matched: []fileMatch{}, Skipped: []fileMatch{}}
+
+	for _, f := range files {
+		var path, skip string
+		for _, p := range w.Paths {
+			match, err := matchPath(p, f, w.RegexPaths)
+			if err != nil {
+				return e, err
+			}
+			if match {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			continue
+		}
+
+		for _, sp := range w.SkipPaths {
+			match, err := matchPath(sp, f, w.RegexPaths)
+			if err != nil {
+				return e, err
+			}
+			if match {
+				skip = sp
+				break
+			}
+		}
+
+		if skip != "" {
+			e.Skipped = append(e.Skipped, fileMatch{File: f, Pattern: skip})
+		} else {
+			e.Matched = append(e.Matched, fileMatch{File: f, Pattern: path})
+		}
+	}
+
+	// like summarize, a watch is only excepted once a file matched it
+	if len(e.Matched) == 0 {
+		return e, nil
+	}
+
+	file, pattern, err := exceptedFile(w, files)
+	if err != nil {
+		return e, err
+	}
+	if file != "" {
+		e.Excepted = &fileMatch{File: file, Pattern: pattern}
+	}
+
+	return e, nil
+}
+
+// print writes the explanation in a human readable form
+func (e watchExplanation) print(out io.Writer) {
+	w := e.Watch
+	fmt.Fprintf(out, "watch %s\n", w.Name)
+
+	switch {
+	case w.Default != nil:
+		fmt.Fprintln(out, "  default config: runs when no other watch generates steps")
+		return
+	case w.Always != nil:
+		fmt.Fprintln(out, "  always config: runs when the diff finds changes")
+		return
+	case w.Uncovered != nil:
+		fmt.Fprintln(out, "  uncovered config: runs when changed files match no watch")
+		return
+	}
+
+	for _, m := range e.Matched {
+		fmt.Fprintf(out, "  matched   %s (path %s)\n", m.File, m.Pattern)
+	}
+	for _, m := range e.Skipped {
+		fmt.Fprintf(out, "  skipped   %s (skip_path %s)\n", m.File, m.Pattern)
+	}
+
+	switch {
+	case e.Excepted != nil:
+		fmt.Fprintf(out, "  excepted  %s (except_path %s), the watch generates no steps\n", e.Excepted.File, e.Excepted.Pattern)
+	case len(e.Matched) == 0:
+		fmt.Fprintln(out, "  no changed files matched, the watch generates no steps")
+	}
+}
+
+// explainCommand prints why each watch of a config matched the changed
+// files or not, and the pipeline they generate
+func explainCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	config := flags.String("config", ".buildkite/pipeline.yml", "pipeline or plugin config file")
+	step := flags.String("step", "", "label or key of the plugin step, when the pipeline has several")
+	filesPath := flags.String("files", "", "file listing the changed files, one per line, or - for stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	plugin, err := loadConfig(*config, *step)
+	if err != nil {
+		return err
+	}
+
+	setupLogger(plugin.LogLevel, plugin.LogFormat)
+
+	files, err := readFiles(*filesPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%d changed files\n\n", len(files))
+
+	for _, w := range plugin.Watch {
+		e, err := explainWatch(w, files)
+		if err != nil {
+			return fmt.Errorf("watch %s: %v", w.Name, err)
+		}
+		e.print(out)
+		fmt.Fprintln(out)
+	}
+
+	steps, err := stepsToTrigger(files, plugin)
+	if err != nil {
+		return err
+	}
+
+	data, _, err := marshalPipeline(steps, plugin)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Generated pipeline:\n%s", data)
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplainWatch(t *testing.T) {
+	w := WatchConfig{
+		Name:        "api",
+		Paths:       []string{"services/api/", "lib/**/*.go"},
+		SkipPaths:   []string{"services/api/docs/"},
+		ExceptPaths: []string{"services/api/VERSION"},
+	}
+
+	got, err := explainWatch(w, []string{"services/api/main.go", "services/api/docs/a.md", "lib/x/y.go", "README.md", "services/api/VERSION"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []fileMatch{
+		{File: "services/api/main.go", Pattern: "services/api/"},
+		{File: "lib/x/y.go", Pattern: "lib/**/*.go"},
+		{File: "services/api/VERSION", Pattern: "services/api/"},
+	}, got.Matched)
+	assert.Equal(t, []fileMatch{{File: "services/api/docs/a.md", Pattern: "services/api/docs/"}}, got.Skipped)
+	assert.Equal(t, &fileMatch{File: "services/api/VERSION", Pattern: "services/api/VERSION"}, got.Excepted)
+}
+
+func TestExplainWatchExceptsLikeSummarize(t *testing.T) {
+	w := WatchConfig{
+		Name:        "api",
+		Paths:       []string{"services/api/"},
+		ExceptPaths: []string{"docs/**", "services/api/VERSION"},
+	}
+
+	// a watch no file matched isn't excepted
+	got, err := explainWatch(w, []string{"docs/index.md"})
+	require.NoError(t, err)
+	assert.Nil(t, got.Excepted)
+
+	files := []string{"services/api/VERSION", "services/api/main.go", "docs/index.md"}
+	got, err = explainWatch(w, files)
+	require.NoError(t, err)
+	assert.Equal(t, &fileMatch{File: "docs/index.md", Pattern: "docs/**"}, got.Excepted)
+
+	result, err := summarize(files, Plugin{Watch: []WatchConfig{w}})
+	require.NoError(t, err)
+	assert.Equal(t, "excepted: docs/index.md", result.Watches[0].Reason)
+}
+
+func TestLoadConfigFromPipeline(t *testing.T) {
+	dir := t.TempDir()
+	pipeline := filepath.Join(dir, "pipeline.yml")
+	require.NoError(t, os.WriteFile(pipeline, []byte(`
+steps:
+  - command: echo unrelated
+  - group: ":buildkite: Monorepo"
+    steps:
+      - label: "Triggering pipelines"
+        plugins:
+          - docker#v5.0.0:
+              image: alpine
+          - monorepo-diff#v1.11.1:
+              watch:
+                - path: services/api/
+                  config:
+                    command: make api
+`), 0o644))
+
+	got, err := loadConfig(pipeline, "")
+	require.NoError(t, err)
+	require.Len(t, got.Watch, 1)
+	assert.Equal(t, "services-api", got.Watch[0].Name)
+	assert.Equal(t, []Step{{Command: "make api"}}, got.Watch[0].Steps)
+
+	config := filepath.Join(dir, "config.yml")
+	require.NoError(t, os.WriteFile(config, []byte(`
+watch:
+  - path: services/web/
+    config:
+      command: make web
+`), 0o644))
+
+	got, err = loadConfig(config, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"services/web/"}, got.Watch[0].Paths)
+
+	_, err = loadConfig(filepath.Join(dir, "missing.yml"), "")
+	assert.ErrorContains(t, err, "could not read config")
+
+	empty := filepath.Join(dir, "empty.yml")
+	require.NoError(t, os.WriteFile(empty, []byte("steps:\n  - command: echo\n"), 0o644))
+	_, err = loadConfig(empty, "")
+	assert.EqualError(t, err, "no monorepo-diff plugin config found in "+empty)
+}
+
+func TestExplainCommand(t *testing.T) {
+	level := log.GetLevel()
+	t.Cleanup(func() { log.SetLevel(level) })
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.yml")
+	require.NoError(t, os.WriteFile(config, []byte(`
+log_level: error
+watch:
+  - name: api
+    path: services/api/
+    skip_path: services/api/docs/
+    config:
+      command: make api
+  - name: web
+    path: services/web/
+    config:
+      command: make web
+  - default:
+      command: echo default
+`), 0o644))
+
+	files := filepath.Join(dir, "files.txt")
+	require.NoError(t, os.WriteFile(files, []byte("services/api/main.go\nservices/api/docs/a.md\n"), 0o644))
+
+	var out bytes.Buffer
+	err := runCommand([]string{"explain", "--config", config, "--files", files}, &out)
+	require.NoError(t, err)
+
+	want := `2 changed files
+
+watch api
+  matched   services/api/main.go (path services/api/)
+  skipped   services/api/docs/a.md (skip_path services/api/docs/)
+
+watch web
+  no changed files matched, the watch generates no steps
+
+watch default
+  default config: runs when no other watch generates steps
+
+Generated pipeline:
+steps:
+    - command: make api
+`
+	assert.Equal(t, want, out.String())
+}
+
+func TestRunCommandUnknown(t *testing.T) {
+	err := runCommand([]string{"deploy"}, &bytes.Buffer{})
+	assert.EqualError(t, err, `unknown command "deploy", expected explain, validate or run`)
+}
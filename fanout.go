@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// forEachMatchedDir generates one copy of a watch's config per matched directory
+const forEachMatchedDir = "matched_dir"
+
+var invalidKeyChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// matchedDirs returns the sorted, unique directories of files truncated to
+// depth path segments. Files with fewer than depth directories are ignored.
+func matchedDirs(files []string, depth int) []string {
+	if depth < 1 {
+		depth = 1
+	}
+
+	seen := map[string]bool{}
+	dirs := []string{}
+
+	for _, f := range files {
+		segments := strings.Split(path.Dir(f), "/")
+		if path.Dir(f) == "." || len(segments) < depth {
+			log.WithFields(log.Fields{"phase": phaseMatch, "file": f}).Debugf("for_each: %s is not nested %d directories deep, ignoring", f, depth)
+			continue
+		}
+
+		dir := strings.Join(segments[:depth], "/")
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	sort.Strings(dirs)
+
+	return dirs
+}
+
+// fanOut returns the template data for each fan-out copy of a watch, one
+// per directory matched at depth, with Dir, Name and MatchedFiles set for it.
+func fanOut(data templateData, depth int) []templateData {
+	copies := []templateData{}
+	for _, dir := range matchedDirs(data.MatchedFiles, depth) {
+		c := data
+		c.Dir = dir
+		c.Name = path.Base(dir)
+		c.MatchedFiles = []string{}
+		for _, f := range data.MatchedFiles {
+			if strings.HasPrefix(f, dir+"/") {
+				c.MatchedFiles = append(c.MatchedFiles, f)
+			}
+		}
+		copies = append(copies, c)
+	}
+
+	return copies
+}
+
+// fanOutSteps returns a copy of steps rendered for the fan-out copy
+// described by data. Keys that are not templated are suffixed with the
+// directory so every copy stays unique, and depends_on references to them
+// are updated to match. Templated keys are suffixed too when they render
+// to a key in used, the keys of the copies before, such as for two
+// directories with the same name. The keys of the copy are added to used.
+func fanOutSteps(steps []Step, data templateData, used map[string]bool) ([]Step, error) {
+	suffixed := map[string]bool{}
+	collectStaticKeys(steps, suffixed)
+
+	suffix := "-" + strings.Trim(invalidKeyChars.ReplaceAllString(data.Dir, "-"), "-")
+
+	rendered, err := renderSteps(steps, data)
+	if err != nil {
+		return nil, fmt.Errorf("for_each %s: %v", data.Dir, err)
+	}
+
+	for key := range stepKeys(rendered) {
+		if used[key] && !suffixed[key] {
+			log.WithFields(log.Fields{"phase": phaseGenerate, "watch": data.Watch}).Infof("for_each %s: key %q is already used by another directory, suffixing it", data.Dir, key)
+			suffixed[key] = true
+		}
+	}
+
+	for i := range rendered {
+		suffixKeys(&rendered[i], suffixed, suffix)
+	}
+
+	for key := range stepKeys(rendered) {
+		used[key] = true
+	}
+
+	return rendered, nil
+}
+
+// collectStaticKeys records the step keys that contain no template
+func collectStaticKeys(steps []Step, keys map[string]bool) {
+	for _, step := range steps {
+		if step.Key != "" && !strings.Contains(step.Key, "{{") {
+			keys[step.Key] = true
+		}
+		collectStaticKeys(step.Steps, keys)
+	}
+}
+
+// suffixKeys adds suffix to the keys of step and its nested steps in
+// suffixed, and to the depends_on references to them
+func suffixKeys(step *Step, static map[string]bool, suffix string) {
+	if static[step.Key] {
+		step.Key += suffix
+	}
+
+	switch dependsOn := step.DependsOn.(type) {
+	case string:
+		if static[dependsOn] {
+			step.DependsOn = dependsOn + suffix
+		}
+	case []interface{}:
+		for i, dep := range dependsOn {
+			switch dep := dep.(type) {
+			case string:
+				if static[dep] {
+					dependsOn[i] = dep + suffix
+				}
+			case map[string]interface{}:
+				if key, ok := isString(dep["step"]); ok && static[key] {
+					dep["step"] = key + suffix
+				}
+			}
+		}
+	}
+
+	for i := range step.Steps {
+		suffixKeys(&step.Steps[i], static, suffix)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchedDirs(t *testing.T) {
+	files := []string{
+		"services/web/index.ts",
+		"services/api/main.go",
+		"services/api/internal/handler.go",
+		"services/README.md",
+		"Makefile",
+	}
+
+	assert.Equal(t, []string{"services"}, matchedDirs(files, 0))
+	assert.Equal(t, []string{"services"}, matchedDirs(files, 1))
+	assert.Equal(t, []string{"services/api", "services/web"}, matchedDirs(files, 2))
+	assert.Equal(t, []string{"services/api/internal"}, matchedDirs(files, 3))
+}
+
+func TestFanOut(t *testing.T) {
+	data := templateData{
+		Watch:        "services",
+		MatchedFiles: []string{"services/web/index.ts", "services/api/main.go", "services/api/go.mod"},
+	}
+
+	assert.Equal(t, []templateData{
+		{
+			Watch:        "services",
+			MatchedFiles: []string{"services/api/main.go", "services/api/go.mod"},
+			Dir:          "services/api",
+			Name:         "api",
+		},
+		{
+			Watch:        "services",
+			MatchedFiles: []string{"services/web/index.ts"},
+			Dir:          "services/web",
+			Name:         "web",
+		},
+	}, fanOut(data, 2))
+}
+
+func TestFanOutStepsRendersDirAndName(t *testing.T) {
+	steps := []Step{{
+		Label:   ":go: Test {{.Name}}",
+		Command: "cd {{.Dir}} && make test",
+		Env:     map[string]string{"SERVICE": "{{.Name}}"},
+	}}
+
+	got, err := fanOutSteps(steps, templateData{Dir: "services/api", Name: "api"}, map[string]bool{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []Step{{
+		Label:   ":go: Test api",
+		Command: "cd services/api && make test",
+		Env:     map[string]string{"SERVICE": "api"},
+	}}, got)
+
+	// the watch config itself must not be modified
+	assert.Equal(t, "{{.Name}}", steps[0].Env["SERVICE"])
+}
+
+func TestFanOutStepsSuffixesStaticKeys(t *testing.T) {
+	steps := []Step{
+		{Key: "build", Command: "make build"},
+		{Key: "deploy-{{.Name}}", Trigger: "deploy", DependsOn: "build"},
+		{
+			Group:     "checks",
+			DependsOn: []interface{}{"build", map[string]interface{}{"step": "build", "allow_failure": true}},
+			Steps:     []Step{{Key: "lint", Command: "make lint"}},
+		},
+	}
+
+	got, err := fanOutSteps(steps, templateData{Dir: "services/api", Name: "api"}, map[string]bool{})
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+
+	assert.Equal(t, "build-services-api", got[0].Key)
+	assert.Equal(t, "deploy-api", got[1].Key)
+	assert.Equal(t, "build-services-api", got[1].DependsOn)
+	assert.Equal(t, []interface{}{
+		"build-services-api",
+		map[string]interface{}{"step": "build-services-api", "allow_failure": true},
+	}, got[2].DependsOn)
+	assert.Equal(t, "lint-services-api", got[2].Steps[0].Key)
+
+	assert.Equal(t, "build", steps[0].Key)
+	assert.Equal(t, "build", steps[2].DependsOn.([]interface{})[0])
+}
+
+func TestFanOutStepsTemplateError(t *testing.T) {
+	steps := []Step{{Command: "echo {{.Unknown}}"}}
+
+	_, err := fanOutSteps(steps, templateData{Dir: "services/api", Name: "api"}, map[string]bool{})
+	assert.ErrorContains(t, err, "for_each services/api")
+	assert.ErrorContains(t, err, "command")
+}
+
+func TestStepsToTriggerForEachMatchedDir(t *testing.T) {
+	watch := []WatchConfig{
+		{
+			Paths:     []string{"services/"},
+			SkipPaths: []string{"services/legacy/"},
+			ForEach:   forEachMatchedDir,
+			Depth:     2,
+			Steps:     []Step{{Key: "test", Label: "Test {{.Name}}", Command: "make -C {{.Dir}} test"}},
+		},
+	}
+
+	changedFiles := []string{
+		"services/web/index.ts",
+		"services/api/main.go",
+		"services/api/go.mod",
+		"services/legacy/app.rb",
+		"docs/index.md",
+	}
+
+	steps, err := stepsToTrigger(changedFiles, Plugin{Watch: watch})
+	require.NoError(t, err)
+
+	assert.Equal(t, []Step{
+		{Key: "test-services-api", Label: "Test api", Command: "make -C services/api test"},
+		{Key: "test-services-web", Label: "Test web", Command: "make -C services/web test"},
+	}, steps)
+}
+
+func TestStepsToTriggerForEachSuffixesRepeatedTemplatedKeys(t *testing.T) {
+	watch := []WatchConfig{{
+		Name:    "services",
+		Paths:   []string{"apps/", "libs/"},
+		ForEach: forEachMatchedDir,
+		Depth:   2,
+		Steps: []Step{
+			{Key: "test-{{.Name}}", Command: "make -C {{.Dir}} test"},
+			{Command: "make -C {{.Dir}} deploy", DependsOn: "test-{{.Name}}"},
+		},
+	}}
+
+	steps, err := stepsToTrigger([]string{"apps/api/main.go", "libs/api/lib.go"}, Plugin{Watch: watch})
+	require.NoError(t, err)
+
+	assert.Equal(t, []Step{
+		{Key: "test-api", Command: "make -C apps/api test"},
+		{Command: "make -C apps/api deploy", DependsOn: "test-api"},
+		{Key: "test-api-libs-api", Command: "make -C libs/api test"},
+		{Command: "make -C libs/api deploy", DependsOn: "test-api-libs-api"},
+	}, steps)
+}
+
+func TestPluginForEach(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{
+				"path": "services/",
+				"for_each": "matched_dir",
+				"depth": 2,
+				"config": { "command": "make -C {{.Dir}} test" }
+			}]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	require.NoError(t, err)
+	assert.Equal(t, forEachMatchedDir, got.Watch[0].ForEach)
+	assert.Equal(t, 2, got.Watch[0].Depth)
+}
+
+func TestPluginForEachRejectsUnknownValue(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{
+				"path": "services/",
+				"for_each": "matched_file",
+				"config": { "command": "make test" }
+			}]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, `unsupported for_each value "matched_file", expected "matched_dir"`)
+}
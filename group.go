@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// groupByWatch wraps the steps generated for each watch in a group
+const groupByWatch = "watch"
+
+// validateGroupBy checks the watch level group attributes are only used
+// when watches are grouped
+func validateGroupBy(groupBy string, watches []WatchConfig) error {
+	if groupBy != "" && groupBy != groupByWatch {
+		return fmt.Errorf("unsupported group_by value %q, expected %q", groupBy, groupByWatch)
+	}
+
+	for _, w := range watches {
+		if w.Key == "" && w.DependsOn == nil && w.Condition == "" {
+			continue
+		}
+		if groupBy == "" {
+			return fmt.Errorf("watch %s: key, depends_on and if require group_by: %s", w.Name, groupByWatch)
+		}
+
+		// a group config can't be wrapped, so it gets the attributes itself
+		hasGroup := slices.ContainsFunc(w.Steps, func(s Step) bool { return s.Group != "" })
+		if !hasGroup {
+			continue
+		}
+		if len(w.Steps) > 1 || w.ForEach != "" {
+			return fmt.Errorf("watch %s: key, depends_on and if only apply to a config of a single group, as groups can't be nested", w.Name)
+		}
+		if w.Key != "" && w.Steps[0].Key != "" {
+			return fmt.Errorf("watch %s: key %q conflicts with the key %q of its group", w.Name, w.Key, w.Steps[0].Key)
+		}
+	}
+
+	return nil
+}
+
+// groupWatchSteps wraps the steps generated for w in a group named after
+// it, with the watch's key, depends_on and if. A single step isn't wrapped
+// and gets those attributes itself, combined with its own, unless both
+// have a key, and so does a single group, as Buildkite doesn't allow
+// nested groups. Other steps that include a group aren't wrapped, and it
+// fails when w has attributes for them, such as when a matrix split into a
+// group.
+func groupWatchSteps(steps []generatedStep, w WatchConfig) ([]generatedStep, error) {
+	actions := 0
+	for _, s := range steps {
+		if s.Step.Group != "" {
+			if len(steps) == 1 {
+				if w.Key != "" && s.Step.Key != "" && s.Step.Key != w.Key {
+					return nil, fmt.Errorf("watch %s: key %q conflicts with the key %q of its group", w.Name, w.Key, s.Step.Key)
+				}
+				applyWatchAttributes(&steps[0].Step, w)
+				return steps, nil
+			}
+			if w.Key != "" || w.DependsOn != nil || w.Condition != "" {
+				return nil, fmt.Errorf("watch %s: key, depends_on and if can't apply to steps that include group %q, as groups can't be nested", w.Name, s.Step.Group)
+			}
+			log.WithFields(log.Fields{"phase": phaseGenerate, "watch": w.Name}).Debugf("watch %s: not grouping steps that include group %q", w.Name, s.Step.Group)
+			return steps, nil
+		}
+		if s.Step.Wait == nil {
+			actions++
+		}
+	}
+
+	// a step with a key of its own is still grouped, so both keys resolve
+	if len(steps) == 1 && actions == 1 && (steps[0].Step.Key == "" || w.Key == "") {
+		applyWatchAttributes(&steps[0].Step, w)
+		return steps, nil
+	}
+
+	if actions == 0 {
+		return steps, nil
+	}
+
+	group := generatedStep{
+		Step: Step{
+			Group:     w.Name,
+			Key:       w.Key,
+			DependsOn: w.DependsOn,
+			Condition: w.Condition,
+			Steps:     []Step{},
+		},
+		Files:   []string{},
+		Watches: watchNames(w),
+	}
+	for _, s := range steps {
+		group.Step.Steps = append(group.Step.Steps, s.Step)
+		group.Files = mergeFiles(group.Files, s.Files)
+	}
+
+	return []generatedStep{group}, nil
+}
+
+// applyWatchAttributes gives step the key of w when it has none, and adds
+// the depends_on and if of w to its own
+func applyWatchAttributes(step *Step, w WatchConfig) {
+	if step.Key == "" {
+		step.Key = w.Key
+	}
+	if step.Condition != "" && w.Condition != "" {
+		step.Condition = fmt.Sprintf("(%s) && (%s)", w.Condition, step.Condition)
+	} else if step.Condition == "" {
+		step.Condition = w.Condition
+	}
+	if w.DependsOn != nil {
+		step.DependsOn = appendDependsOn(step.DependsOn, dependsOnList(w.DependsOn))
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupWatchSteps(t *testing.T) {
+	w := WatchConfig{Name: "api", Key: "api", DependsOn: "lint", Condition: "build.branch == 'main'"}
+
+	steps := []generatedStep{
+		{Step: Step{Command: "make test"}, Files: []string{"api/a.go"}, Watches: []string{"api"}},
+		{Step: Step{Wait: &WaitStep{}}, Files: []string{"api/a.go"}, Watches: []string{"api"}},
+		{Step: Step{Trigger: "deploy-api"}, Files: []string{"api/b.go"}, Watches: []string{"api"}},
+	}
+
+	assert.Equal(t, []generatedStep{{
+		Step: Step{
+			Group:     "api",
+			Key:       "api",
+			DependsOn: "lint",
+			Condition: "build.branch == 'main'",
+			Steps:     []Step{{Command: "make test"}, {Wait: &WaitStep{}}, {Trigger: "deploy-api"}},
+		},
+		Files:   []string{"api/a.go", "api/b.go"},
+		Watches: []string{"api"},
+	}}, mustGroupWatchSteps(t, steps, w))
+}
+
+func mustGroupWatchSteps(t *testing.T, steps []generatedStep, w WatchConfig) []generatedStep {
+	t.Helper()
+
+	got, err := groupWatchSteps(steps, w)
+	require.NoError(t, err)
+
+	return got
+}
+
+func TestGroupWatchStepsSingleStep(t *testing.T) {
+	w := WatchConfig{Name: "api", Key: "api", DependsOn: "lint", Condition: "build.branch == 'main'"}
+
+	single := []generatedStep{{Step: Step{Command: "make test", DependsOn: "setup", Condition: "build.pull_request.id == null"}}}
+	assert.Equal(t, Step{
+		Command:   "make test",
+		Key:       "api",
+		DependsOn: []interface{}{"setup", "lint"},
+		Condition: "(build.branch == 'main') && (build.pull_request.id == null)",
+	}, mustGroupWatchSteps(t, single, w)[0].Step)
+
+	// a step with its own key is grouped so both keys can be depended on
+	keyed := []generatedStep{{Step: Step{Command: "make test", Key: "test"}}}
+	got := mustGroupWatchSteps(t, keyed, w)
+	require.Len(t, got, 1)
+	assert.Equal(t, "api", got[0].Step.Group)
+	assert.Equal(t, []Step{{Command: "make test", Key: "test"}}, got[0].Step.Steps)
+}
+
+func TestGroupWatchStepsDoesNotNestGroups(t *testing.T) {
+	steps := []generatedStep{
+		{Step: Step{Group: "checks", Steps: []Step{{Command: "lint"}}}},
+		{Step: Step{Command: "make test"}},
+	}
+
+	assert.Equal(t, steps, mustGroupWatchSteps(t, steps, WatchConfig{Name: "api"}))
+
+	_, err := groupWatchSteps(steps, WatchConfig{Name: "api", DependsOn: "lint"})
+	assert.EqualError(t, err, `watch api: key, depends_on and if can't apply to steps that include group "checks", as groups can't be nested`)
+}
+
+func TestGroupWatchStepsSingleGroup(t *testing.T) {
+	w := WatchConfig{Name: "api", Key: "api", DependsOn: "lint", Condition: `build.branch == "main"`}
+
+	steps := []generatedStep{{Step: Step{Group: "API", Steps: []Step{{Command: "make deploy"}}}}}
+	assert.Equal(t, Step{
+		Group:     "API",
+		Key:       "api",
+		DependsOn: []interface{}{"lint"},
+		Condition: `build.branch == "main"`,
+		Steps:     []Step{{Command: "make deploy"}},
+	}, mustGroupWatchSteps(t, steps, w)[0].Step)
+
+	keyed := []generatedStep{{Step: Step{Group: "API", Key: "deploy", Steps: []Step{{Command: "make deploy"}}}}}
+	_, err := groupWatchSteps(keyed, w)
+	assert.EqualError(t, err, `watch api: key "api" conflicts with the key "deploy" of its group`)
+}
+
+func TestStepsToTriggerGroupsSplitMatrix(t *testing.T) {
+	var files []string
+	for i := 0; i < 25; i++ {
+		files = append(files, fmt.Sprintf("packages/p%02d/main.go", i))
+	}
+
+	w := WatchConfig{
+		Name:  "packages",
+		Paths: []string{"packages/"},
+		Depth: 2,
+		Steps: []Step{
+			{Label: "Test", Command: "make test", Matrix: map[string]interface{}{"from_matched": "dir"}},
+			{Command: "make lint"},
+		},
+	}
+
+	// without watch attributes the split matrix is left ungrouped
+	steps, err := stepsToTrigger(files, Plugin{GroupBy: groupByWatch, Watch: []WatchConfig{w}})
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+	assert.Equal(t, "Test", steps[0].Group)
+	assert.Len(t, steps[0].Steps, 2)
+	assert.Equal(t, Step{Command: "make lint"}, steps[1])
+
+	w.DependsOn = "setup"
+	_, err = stepsToTrigger(files, Plugin{GroupBy: groupByWatch, Watch: []WatchConfig{w}})
+	assert.EqualError(t, err, `watch packages: key, depends_on and if can't apply to steps that include group "Test", as groups can't be nested`)
+
+	// a single split matrix gets the watch attributes itself
+	w.Steps = w.Steps[:1]
+	steps, err = stepsToTrigger(files, Plugin{GroupBy: groupByWatch, Watch: []WatchConfig{w}})
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	assert.Equal(t, "Test", steps[0].Group)
+	assert.Equal(t, []interface{}{"setup"}, steps[0].DependsOn)
+}
+
+func TestValidateGroupBy(t *testing.T) {
+	assert.NoError(t, validateGroupBy("", []WatchConfig{{Name: "api"}}))
+	assert.NoError(t, validateGroupBy(groupByWatch, []WatchConfig{{Name: "api", Key: "api"}}))
+
+	err := validateGroupBy("path", nil)
+	assert.EqualError(t, err, `unsupported group_by value "path", expected "watch"`)
+
+	err = validateGroupBy("", []WatchConfig{{Name: "api", Condition: "build.branch == 'main'"}})
+	assert.EqualError(t, err, "watch api: key, depends_on and if require group_by: watch")
+
+	group := Step{Group: "API", Key: "deploy", Steps: []Step{{Command: "make deploy"}}}
+	assert.NoError(t, validateGroupBy(groupByWatch, []WatchConfig{{Name: "api", Condition: "build.branch == 'main'", Steps: []Step{group}}}))
+
+	err = validateGroupBy(groupByWatch, []WatchConfig{{Name: "api", Condition: "build.branch == 'main'", Steps: []Step{group, {Command: "make test"}}}})
+	assert.EqualError(t, err, "watch api: key, depends_on and if only apply to a config of a single group, as groups can't be nested")
+
+	err = validateGroupBy(groupByWatch, []WatchConfig{{Name: "api", Key: "api", Steps: []Step{group}}})
+	assert.EqualError(t, err, `watch api: key "api" conflicts with the key "deploy" of its group`)
+}
+
+func TestGeneratePipelineGroupedByWatch(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"group_by": "watch",
+			"watch": [
+				{
+					"name": "api",
+					"path": "services/api/",
+					"key": "api",
+					"if": "build.branch == 'main'",
+					"config": [
+						{ "command": "make test" },
+						{ "trigger": "deploy-api", "build": { "message": "Deploy" } }
+					]
+				},
+				{
+					"name": "web",
+					"path": "services/web/",
+					"depends_on": "api",
+					"config": { "command": "npm test" }
+				}
+			]
+		}
+	}]`
+
+	plugin, err := initializePlugin(param)
+	require.NoError(t, err)
+
+	steps, err := stepsToTrigger([]string{"services/api/main.go", "services/web/index.ts"}, plugin)
+	require.NoError(t, err)
+
+	pipeline, _, err := generatePipeline(steps, Plugin{})
+	require.NoError(t, err)
+	defer func() {
+		if err = os.Remove(pipeline.Name()); err != nil {
+			t.Logf("Failed to remove temporary pipeline file: %v", err)
+		}
+	}()
+
+	got, err := os.ReadFile(pipeline.Name())
+	require.NoError(t, err)
+
+	want := `steps:
+    - group: api
+      key: api
+      steps:
+        - command: make test
+        - trigger: deploy-api
+          build:
+            message: Deploy
+            branch: go-rewrite
+            commit: "123"
+      if: build.branch == 'main'
+    - command: npm test
+      depends_on:
+        - api
+`
+
+	assert.Equal(t, want, string(got))
+}
+
+func TestPluginGroupConfigWithWatchAttributes(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"group_by": "watch",
+			"watch": [{
+				"name": "api",
+				"path": "services/api/",
+				"key": "api",
+				"if": "build.branch == \"main\"",
+				"config": { "group": "API", "steps": [{ "command": "make deploy" }] }
+			}]
+		}
+	}]`
+
+	plugin, err := initializePlugin(param)
+	require.NoError(t, err)
+
+	steps, err := stepsToTrigger([]string{"services/api/main.go"}, plugin)
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	assert.Equal(t, "api", steps[0].Key)
+	assert.Equal(t, `build.branch == "main"`, steps[0].Condition)
+
+	_, err = initializePlugin(strings.Replace(param, `"config": {`, `"for_each": "matched_dir", "config": {`, 1))
+	assert.EqualError(t, err, "watch api: key, depends_on and if only apply to a config of a single group, as groups can't be nested")
+}
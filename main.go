@@ -1,13 +1,34 @@
 package main
 
 import (
+	"os"
+
 	log "github.com/sirupsen/logrus"
 )
 
-func setupLogger(logLevel string) {
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp: true,
-	})
+// Supported log_format values
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Phases of a run, logged in the phase field so log processors can follow
+// the decisions taken
+const (
+	phaseDiff     = "diff"
+	phaseMatch    = "match"
+	phaseGenerate = "generate"
+	phaseUpload   = "upload"
+)
+
+func setupLogger(logLevel, logFormat string) {
+	if logFormat == logFormatJSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{
+			FullTimestamp: true,
+		})
+	}
 
 	ll, err := log.ParseLevel(logLevel)
 	if err != nil {
@@ -15,12 +36,24 @@ func setupLogger(logLevel string) {
 	}
 
 	log.SetLevel(ll)
+
+	if err != nil {
+		log.Warnf("unsupported log_level value %q, using %q", logLevel, ll)
+	}
 }
 
 // Version of plugin
 var version string = "dev"
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:], os.Stdout); err != nil {
+			log.Error(err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
 	log.Infof("--- running monorepo-diff-buildkite-plugin %s", version)
 
 	plugins := env("BUILDKITE_PLUGINS", "")
@@ -29,17 +62,14 @@ func main() {
 
 	plugin, err := initializePlugin(plugins)
 	if err != nil {
-		log.Debug(err)
-		log.Fatal(err)
+		log.Error(err)
+		os.Exit(exitConfig)
 	}
 
-	setupLogger(plugin.LogLevel)
-
-	if env("BUILDKITE_PLUGIN_MONOREPO_DIFF_BUILDKITE_PLUGIN_TEST_MODE", "false") == "true" {
-		return
-	}
+	setupLogger(plugin.LogLevel, plugin.LogFormat)
 
-	if _, _, err = uploadPipeline(plugin, generatePipeline); err != nil {
-		log.Fatalf("+++ failed to upload pipeline: %v", err)
+	if err = uploadPipeline(plugin, generatePipeline, newUploader(plugin, os.Stdout)); err != nil {
+		log.Errorf("+++ failed to upload pipeline: %v", err)
+		os.Exit(exitCode(err))
 	}
 }
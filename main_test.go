@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,7 +19,6 @@ func TestMain(m *testing.M) {
 	_ = os.Setenv("BUILDKITE_BRANCH", "go-rewrite")
 	_ = os.Setenv("env3", "env-3")
 	_ = os.Setenv("env4", "env-4")
-	_ = os.Setenv("TEST_MODE", "true")
 
 	run := m.Run()
 
@@ -26,8 +26,61 @@ func TestMain(m *testing.M) {
 }
 
 func TestSetupLogger(t *testing.T) {
-	setupLogger("debug")
+	t.Cleanup(func() { setupLogger("debug", "") })
+
+	setupLogger("debug", "")
 	assert.Equal(t, log.GetLevel(), log.DebugLevel)
-	setupLogger("weird level")
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+	setupLogger("weird level", "")
 	assert.Equal(t, log.GetLevel(), log.InfoLevel)
+	assert.Equal(t, `unsupported log_level value "weird level", using "info"`, hook.LastEntry().Message)
+	setupLogger("fatal", "")
+	assert.Equal(t, log.GetLevel(), log.FatalLevel)
+	setupLogger("trace", "")
+	assert.Equal(t, log.GetLevel(), log.TraceLevel)
+	setupLogger("warn", "")
+	assert.Equal(t, log.GetLevel(), log.WarnLevel)
+	setupLogger("error", "")
+	assert.Equal(t, log.GetLevel(), log.ErrorLevel)
+	assert.IsType(t, &log.TextFormatter{}, log.StandardLogger().Formatter)
+
+	setupLogger("info", "json")
+	assert.IsType(t, &log.JSONFormatter{}, log.StandardLogger().Formatter)
+}
+
+func TestStepsToTriggerLogsStructuredFields(t *testing.T) {
+	hook := logtest.NewGlobal()
+	log.SetLevel(log.TraceLevel)
+	t.Cleanup(func() {
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+		log.SetLevel(log.DebugLevel)
+	})
+
+	plugin := Plugin{Watch: []WatchConfig{{
+		Name:      "api",
+		Paths:     []string{"services/api/"},
+		SkipPaths: []string{"services/api/docs/"},
+		Steps:     []Step{{Command: "make api"}},
+	}}}
+
+	_, err := stepsToTrigger([]string{"services/api/main.go", "services/api/docs/a.md"}, plugin)
+	assert.NoError(t, err)
+
+	fields := []log.Fields{}
+	for _, e := range hook.AllEntries() {
+		if e.Level == log.TraceLevel {
+			fields = append(fields, e.Data)
+		}
+	}
+
+	assert.Equal(t, []log.Fields{
+		{"phase": "match", "watch": "api", "file": "services/api/main.go", "pattern": "services/api/"},
+		{"phase": "match", "watch": "api", "file": "services/api/docs/a.md", "pattern": "services/api/docs/"},
+		{"phase": "match", "watch": "api", "file": "services/api/docs/a.md", "pattern": "services/api/"},
+	}, fields)
+
+	last := hook.LastEntry()
+	assert.Equal(t, "watch api: 1 of 2 changed files matched", last.Message)
+	assert.Equal(t, log.Fields{"phase": "match", "watch": "api"}, last.Data)
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	// matchedFilesEnv holds the newline separated files that matched a watch
+	matchedFilesEnv = "MONOREPO_DIFF_MATCHED_FILES"
+	// matchedFilesArtifactEnv holds the artifact path of a matched files
+	// list too large to pass in matchedFilesEnv
+	matchedFilesArtifactEnv = "MONOREPO_DIFF_MATCHED_FILES_ARTIFACT"
+	// matchedFilesEnvLimit is the largest list, in bytes, passed in the env
+	matchedFilesEnvLimit = 32 * 1024
+)
+
+// mergeFiles returns a followed by the files of b it doesn't already contain
+func mergeFiles(a, b []string) []string {
+	merged := append([]string{}, a...)
+	seen := make(map[string]bool, len(a))
+	for _, f := range a {
+		seen[f] = true
+	}
+
+	for _, f := range b {
+		if !seen[f] {
+			seen[f] = true
+			merged = append(merged, f)
+		}
+	}
+
+	return merged
+}
+
+// withMatchedFiles returns a copy of step with files in the env of every
+// command step, and the build env of every trigger step, it contains.
+// Values already set in the step's config are left alone.
+func withMatchedFiles(step Step, files []string) Step {
+	list := strings.Join(files, "\n")
+
+	if step.Command != nil || step.Commands != nil {
+		if _, ok := step.Env[matchedFilesEnv]; !ok {
+			step.Env = withEnv(step.Env, matchedFilesEnv, list)
+			step.MatchedFiles = true
+		}
+	} else if step.Trigger != "" {
+		if _, ok := step.Build.Env[matchedFilesEnv]; !ok {
+			step.Build.Env = withEnv(step.Build.Env, matchedFilesEnv, list)
+			step.MatchedFiles = true
+		}
+	}
+
+	if step.Steps != nil {
+		nested := make([]Step, len(step.Steps))
+		for i, n := range step.Steps {
+			nested[i] = withMatchedFiles(n, files)
+		}
+		step.Steps = nested
+	}
+
+	return step
+}
+
+// withEnv returns a copy of env with key set to value, unless already set
+func withEnv(env map[string]string, key, value string) map[string]string {
+	if _, ok := env[key]; ok {
+		return env
+	}
+
+	out := make(map[string]string, len(env)+1)
+	for k, v := range env {
+		out[k] = v
+	}
+	out[key] = value
+
+	return out
+}
+
+// matchedFilesPreparer finalises the matched files lists the plugin set in
+// step env for upload, collecting the lists written out as artifacts.
+type matchedFilesPreparer struct {
+	interpolation bool
+	spill         bool
+	artifacts     []string
+}
+
+// prepareMatchedFiles returns a copy of steps with the matched files lists
+// the plugin set in their env finalised for upload. Lists too large for the
+// environment are written to files and replaced with their path, returned
+// so they can be uploaded as artifacts. Lists passed in the env are escaped
+// when the pipeline upload interpolates.
+func prepareMatchedFiles(steps []Step, interpolation bool) ([]Step, []string, error) {
+	p := &matchedFilesPreparer{interpolation: interpolation, spill: true, artifacts: []string{}}
+	prepared, err := p.steps(steps)
+
+	return prepared, p.artifacts, err
+}
+
+// escapeMatchedFiles returns a copy of steps with the matched files lists
+// the plugin set in their env escaped when the pipeline upload
+// interpolates, for a pipeline that is written out rather than uploaded.
+func escapeMatchedFiles(steps []Step, interpolation bool) []Step {
+	p := &matchedFilesPreparer{interpolation: interpolation}
+	escaped, _ := p.steps(steps)
+
+	return escaped
+}
+
+func (p *matchedFilesPreparer) steps(steps []Step) ([]Step, error) {
+	if steps == nil {
+		return nil, nil
+	}
+
+	out := make([]Step, len(steps))
+	for i, step := range steps {
+		var err error
+		if step.MatchedFiles && (step.Command != nil || step.Commands != nil) {
+			if step.Env, err = p.env(step.Env); err != nil {
+				return nil, err
+			}
+		} else if step.MatchedFiles && step.Trigger != "" {
+			if step.Build.Env, err = p.env(step.Build.Env); err != nil {
+				return nil, err
+			}
+		}
+		if step.Steps, err = p.steps(step.Steps); err != nil {
+			return nil, err
+		}
+		out[i] = step
+	}
+
+	return out, nil
+}
+
+// env returns a copy of env with its matched files list finalised
+func (p *matchedFilesPreparer) env(env map[string]string) (map[string]string, error) {
+	list, ok := env[matchedFilesEnv]
+	if !ok {
+		return env, nil
+	}
+
+	out := make(map[string]string, len(env))
+	for k, v := range env {
+		out[k] = v
+	}
+
+	if !p.spill || len(list) <= matchedFilesEnvLimit {
+		if p.interpolation {
+			out[matchedFilesEnv] = escapeInterpolation(list)
+		}
+		return out, nil
+	}
+
+	sum := sha256.Sum256([]byte(list))
+	name := fmt.Sprintf("monorepo-diff-matched-files-%x.txt", sum[:6])
+
+	if !slices.Contains(p.artifacts, name) {
+		if err := os.WriteFile(name, []byte(list+"\n"), 0o644); err != nil {
+			return nil, fmt.Errorf("could not write matched files list: %v", err)
+		}
+		p.artifacts = append(p.artifacts, name)
+	}
+
+	delete(out, matchedFilesEnv)
+	out[matchedFilesArtifactEnv] = name
+
+	return out, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMatchedFiles(t *testing.T) {
+	files := []string{"api/a.go", "api/b.go"}
+
+	command := Step{Command: "lint", Env: map[string]string{"FOO": "bar"}}
+	got := withMatchedFiles(command, files)
+	assert.Equal(t, map[string]string{"FOO": "bar", matchedFilesEnv: "api/a.go\napi/b.go"}, got.Env)
+	assert.Equal(t, map[string]string{"FOO": "bar"}, command.Env)
+
+	trigger := withMatchedFiles(Step{Trigger: "deploy"}, files)
+	assert.Nil(t, trigger.Env)
+	assert.Equal(t, map[string]string{matchedFilesEnv: "api/a.go\napi/b.go"}, trigger.Build.Env)
+
+	group := withMatchedFiles(Step{Group: "checks", Steps: []Step{{Command: "lint"}, {Trigger: "deploy"}}}, files)
+	assert.Nil(t, group.Env)
+	assert.Equal(t, "api/a.go\napi/b.go", group.Steps[0].Env[matchedFilesEnv])
+	assert.Equal(t, "api/a.go\napi/b.go", group.Steps[1].Build.Env[matchedFilesEnv])
+
+	configured := withMatchedFiles(Step{Command: "lint", Env: map[string]string{matchedFilesEnv: "custom"}}, files)
+	assert.Equal(t, "custom", configured.Env[matchedFilesEnv])
+}
+
+func TestStepsToTriggerPassesMatchedFiles(t *testing.T) {
+	plugin := Plugin{
+		PassMatchedFiles: true,
+		Watch: []WatchConfig{
+			{Paths: []string{"api/"}, Steps: []Step{{Trigger: "deploy"}}},
+			{Paths: []string{"lib/"}, Steps: []Step{{Trigger: "deploy"}}},
+			{Paths: []string{"web/"}, Steps: []Step{{Command: "lint"}}},
+		},
+	}
+
+	steps, err := stepsToTrigger([]string{"api/a.go", "lib/b.go", "web/c.ts", "docs/d.md"}, plugin)
+	require.NoError(t, err)
+
+	// identical steps from different watches are merged with both file lists
+	assert.Equal(t, []Step{
+		{Trigger: "deploy", Build: Build{Env: map[string]string{matchedFilesEnv: "api/a.go\nlib/b.go"}}, MatchedFiles: true},
+		{Command: "lint", Env: map[string]string{matchedFilesEnv: "web/c.ts"}, MatchedFiles: true},
+	}, steps)
+	assert.Nil(t, plugin.Watch[2].Steps[0].Env)
+}
+
+func TestStepsToTriggerPassesMatchedFilesPerFanOutCopy(t *testing.T) {
+	plugin := Plugin{
+		PassMatchedFiles: true,
+		Watch: []WatchConfig{{
+			Paths:   []string{"services/"},
+			ForEach: forEachMatchedDir,
+			Depth:   2,
+			Steps:   []Step{{Command: "make -C {{.Dir}} lint"}},
+		}},
+	}
+
+	steps, err := stepsToTrigger([]string{"services/api/a.go", "services/web/b.ts"}, plugin)
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+	assert.Equal(t, "services/api/a.go", steps[0].Env[matchedFilesEnv])
+	assert.Equal(t, "services/web/b.ts", steps[1].Env[matchedFilesEnv])
+}
+
+func TestStepsToTriggerPassesChangedFilesToDefault(t *testing.T) {
+	plugin := Plugin{
+		PassMatchedFiles: true,
+		Watch: []WatchConfig{
+			{Paths: []string{"api/"}, Steps: []Step{{Command: "echo api"}}},
+			{Default: true, Steps: []Step{{Command: "echo default"}}},
+		},
+	}
+
+	steps, err := stepsToTrigger([]string{"docs/a.md", "docs/b.md"}, plugin)
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	assert.Equal(t, "docs/a.md\ndocs/b.md", steps[0].Env[matchedFilesEnv])
+}
+
+func TestPrepareMatchedFilesEscapesInterpolation(t *testing.T) {
+	steps := []Step{withMatchedFiles(Step{Command: "lint"}, []string{"pay$ment.go"})}
+
+	prepared, artifacts, err := prepareMatchedFiles(steps, true)
+	require.NoError(t, err)
+	assert.Empty(t, artifacts)
+	assert.Equal(t, "pay$$ment.go", prepared[0].Env[matchedFilesEnv])
+	assert.Equal(t, "pay$ment.go", steps[0].Env[matchedFilesEnv])
+
+	prepared, _, err = prepareMatchedFiles(steps, false)
+	require.NoError(t, err)
+	assert.Equal(t, "pay$ment.go", prepared[0].Env[matchedFilesEnv])
+
+	assert.Equal(t, "pay$$ment.go", escapeMatchedFiles(steps, true)[0].Env[matchedFilesEnv])
+}
+
+func TestPrepareMatchedFilesLeavesConfiguredValues(t *testing.T) {
+	env := map[string]string{matchedFilesEnv: "$HOME/files.txt"}
+	steps := []Step{
+		withMatchedFiles(Step{Command: "lint", Env: env}, []string{"pay$ment.go"}),
+		withMatchedFiles(Step{Command: "test", Env: map[string]string{"CI": "$CI"}}, []string{"pay$ment.go"}),
+	}
+
+	prepared, _, err := prepareMatchedFiles(steps, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{matchedFilesEnv: "$HOME/files.txt"}, prepared[0].Env)
+	assert.Equal(t, map[string]string{"CI": "$CI", matchedFilesEnv: "pay$$ment.go"}, prepared[1].Env)
+	assert.Equal(t, map[string]string{matchedFilesEnv: "$HOME/files.txt"}, env)
+}
+
+func TestPrepareMatchedFilesSpillsLargeLists(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	files := make([]string, 2000)
+	for i := range files {
+		files[i] = "services/api/file.go"
+	}
+	list := strings.Join(files, "\n")
+	steps := []Step{
+		withMatchedFiles(Step{Command: "lint"}, files),
+		withMatchedFiles(Step{Trigger: "deploy"}, files),
+	}
+
+	prepared, artifacts, err := prepareMatchedFiles(steps, true)
+	require.NoError(t, err)
+	require.Len(t, artifacts, 1)
+
+	assert.Equal(t, map[string]string{matchedFilesArtifactEnv: artifacts[0]}, prepared[0].Env)
+	assert.Equal(t, map[string]string{matchedFilesArtifactEnv: artifacts[0]}, prepared[1].Build.Env)
+	assert.Equal(t, list, steps[0].Env[matchedFilesEnv])
+
+	got, err := os.ReadFile(artifacts[0])
+	require.NoError(t, err)
+	assert.Equal(t, list+"\n", string(got))
+}
+
+func TestUploadPipelineUploadsLargeMatchedFilesLists(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	var files []string
+	for i := 0; i < 2000; i++ {
+		files = append(files, filepath.Join("services", "api", strings.Repeat("x", 20)+string(rune('a'+i%26))))
+	}
+	require.NoError(t, os.WriteFile("diff.txt", []byte(strings.Join(files, "\n")+"\n"), 0o644))
+
+	plugin := Plugin{
+		Diff:             "cat diff.txt",
+		Interpolation:    true,
+		PassMatchedFiles: true,
+		Watch:            []WatchConfig{{Paths: []string{"services/"}, Steps: []Step{{Command: "lint"}}}},
+	}
+
+	agent, err := bintest.NewMock("buildkite-agent")
+	require.NoError(t, err)
+
+	oldPath := os.Getenv("PATH")
+	t.Cleanup(func() { _ = os.Setenv("PATH", oldPath) })
+	_ = os.Setenv("PATH", filepath.Dir(agent.Path)+":"+oldPath)
+
+	agent.
+		Expect("artifact", "upload", bintest.MatchPattern(`^monorepo-diff-matched-files-[0-9a-f]{12}\.txt$`)).
+		AndExitWith(0)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt").
+		AndExitWith(0)
+
+	err = uploadPipeline(plugin, mockGeneratePipeline, agentUploader{interpolation: plugin.Interpolation})
+	assert.NoError(t, err)
+
+	require.NoError(t, agent.CheckAndClose(t))
+
+	// the list is removed once uploaded
+	leftover, err := filepath.Glob(filepath.Join(dir, "monorepo-diff-matched-files-*"))
+	require.NoError(t, err)
+	assert.Empty(t, leftover)
+}
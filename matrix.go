@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dlclark/regexp2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// matrixFromDir fills the matrix with the watch's matched directories
+	matrixFromDir = "dir"
+	// matrixFromCapture fills the matrix with a capture group of the watch's
+	// regex paths
+	matrixFromCapture = "capture"
+
+	// Buildkite limits the elements of a matrix dimension and the jobs a
+	// single matrix step can create
+	matrixMaxDimensionSize = 20
+	matrixMaxJobs          = 50
+)
+
+// matrixPlaceholder is a step matrix generated from the files matched by a
+// watch, written as `matrix: {from_matched: dir}` in the step config
+type matrixPlaceholder struct {
+	From         string
+	Dimension    string
+	CaptureGroup string
+	Setup        map[string]interface{}
+	Rest         map[string]interface{}
+}
+
+// parseMatrixPlaceholder returns the placeholder in a step's matrix, if any
+func parseMatrixPlaceholder(matrix interface{}) (*matrixPlaceholder, bool) {
+	m, ok := matrix.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	from, ok := m["from_matched"]
+	if !ok {
+		return nil, false
+	}
+
+	p := &matrixPlaceholder{Rest: map[string]interface{}{}}
+	p.From, _ = isString(from)
+	p.Dimension, _ = isString(m["dimension"])
+	p.Setup, _ = m["setup"].(map[string]interface{})
+
+	switch group := m["capture_group"].(type) {
+	case string:
+		p.CaptureGroup = group
+	case float64:
+		p.CaptureGroup = strconv.Itoa(int(group))
+	}
+
+	for k, v := range m {
+		switch k {
+		case "from_matched", "dimension", "capture_group", "setup":
+		default:
+			p.Rest[k] = v
+		}
+	}
+
+	return p, true
+}
+
+// validateMatrixPlaceholders checks the matrix placeholders in a watch's
+// steps can be filled from its matched files
+func validateMatrixPlaceholders(steps []Step, w WatchConfig) error {
+	for _, step := range steps {
+		if p, ok := parseMatrixPlaceholder(step.Matrix); ok {
+			switch {
+			case !w.hasPaths():
+				return errors.New("matrix from_matched is not supported in default, always or uncovered config")
+			case p.From != matrixFromDir && p.From != matrixFromCapture:
+				return fmt.Errorf("unsupported matrix from_matched value %q, expected %q or %q", p.From, matrixFromDir, matrixFromCapture)
+			case p.From == matrixFromCapture && !w.RegexPaths:
+				return errors.New("matrix from_matched: capture requires regex_paths")
+			case p.Setup != nil && p.Dimension == "":
+				return errors.New("matrix from_matched with other setup dimensions requires a dimension name")
+			}
+		}
+
+		if err := validateMatrixPlaceholders(step.Steps, w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandMatrixSteps fills the matrix placeholders of steps with values from
+// the files matched by w. Steps with more values than a single matrix
+// allows are split into several steps.
+func expandMatrixSteps(steps []Step, w WatchConfig, files []string) ([]Step, error) {
+	expanded := []Step{}
+	for _, step := range steps {
+		s, err := expandMatrix(step, w, files, false)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, s...)
+	}
+
+	return expanded, nil
+}
+
+func expandMatrix(step Step, w WatchConfig, files []string, nested bool) ([]Step, error) {
+	if step.Steps != nil {
+		nestedSteps := []Step{}
+		for _, n := range step.Steps {
+			s, err := expandMatrix(n, w, files, true)
+			if err != nil {
+				return nil, err
+			}
+			nestedSteps = append(nestedSteps, s...)
+		}
+		step.Steps = nestedSteps
+	}
+
+	p, ok := parseMatrixPlaceholder(step.Matrix)
+	if !ok {
+		return []Step{step}, nil
+	}
+
+	values, err := matrixValues(p, w, files)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		log.WithFields(log.Fields{"phase": phaseGenerate, "watch": w.Name}).Warnf("Skipping step %q: no matrix values from matched files", stepName(step))
+		return []Step{}, nil
+	}
+
+	jobs := 1
+	for _, dimension := range p.Setup {
+		if list, ok := dimension.([]interface{}); ok && len(list) > 0 {
+			jobs *= len(list)
+		}
+	}
+
+	size := min(matrixMaxDimensionSize, matrixMaxJobs/jobs)
+	if size < 1 {
+		return nil, fmt.Errorf("matrix of step %q has %d jobs before adding matched values, more than the %d Buildkite allows", stepName(step), jobs, matrixMaxJobs)
+	}
+
+	if len(values) <= size {
+		step.Matrix = p.matrix(values)
+		return []Step{step}, nil
+	}
+
+	chunks := []Step{}
+	count := (len(values) + size - 1) / size
+	for i := 0; i < count; i++ {
+		chunk := step
+		chunk.Matrix = p.matrix(values[i*size : min((i+1)*size, len(values))])
+		if chunk.Key != "" {
+			chunk.Key = fmt.Sprintf("%s-%d", step.Key, i+1)
+		}
+		if chunk.Label != "" {
+			chunk.Label = fmt.Sprintf("%s (%d/%d)", step.Label, i+1, count)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	log.WithFields(log.Fields{"phase": phaseGenerate, "watch": w.Name}).Infof("Split matrix of step %q into %d steps of up to %d values", stepName(step), count, size)
+
+	// Buildkite doesn't allow nested groups; otherwise keep the original key
+	// on a group of the chunks so depends_on references still resolve
+	if nested || step.Group != "" {
+		return chunks, nil
+	}
+
+	return []Step{{Group: stepName(step), Key: step.Key, Steps: chunks}}, nil
+}
+
+// matrix returns the Buildkite matrix config with values filled in
+func (p *matrixPlaceholder) matrix(values []string) map[string]interface{} {
+	list := make([]interface{}, len(values))
+	for i, v := range values {
+		list[i] = v
+	}
+
+	matrix := make(map[string]interface{}, len(p.Rest)+1)
+	for k, v := range p.Rest {
+		matrix[k] = v
+	}
+
+	if p.Dimension == "" {
+		matrix["setup"] = list
+		return matrix
+	}
+
+	setup := make(map[string]interface{}, len(p.Setup)+1)
+	for k, v := range p.Setup {
+		setup[k] = v
+	}
+	setup[p.Dimension] = list
+	matrix["setup"] = setup
+
+	return matrix
+}
+
+// matrixValues returns the sorted, unique values for a matrix placeholder
+func matrixValues(p *matrixPlaceholder, w WatchConfig, files []string) ([]string, error) {
+	if p.From == matrixFromDir {
+		return matchedDirs(files, w.Depth), nil
+	}
+
+	group := p.CaptureGroup
+	if group == "" {
+		group = "1"
+	}
+
+	seen := map[string]bool{}
+	values := []string{}
+
+	for _, f := range files {
+		for _, path := range w.Paths {
+			value, ok, err := captureGroup(path, f, group)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+
+			if value != "" && !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+			break
+		}
+	}
+
+	sort.Strings(values)
+
+	return values, nil
+}
+
+// captureGroup returns the named or numbered group captured when the regex
+// path p matches file f
+func captureGroup(p, f, group string) (string, bool, error) {
+	re, err := regexp2.Compile(p, 0)
+	if err != nil {
+		return "", false, fmt.Errorf("regex path matching failed for %q: %v", p, err)
+	}
+	re.MatchTimeout = 5 * time.Second
+
+	m, err := re.FindStringMatch(f)
+	if err != nil {
+		return "", false, fmt.Errorf("regex path matching failed: %v", err)
+	}
+	if m == nil {
+		return "", false, nil
+	}
+
+	var g *regexp2.Group
+	if n, err := strconv.Atoi(group); err == nil {
+		g = m.GroupByNumber(n)
+	} else {
+		g = m.GroupByName(group)
+	}
+
+	if g == nil || len(g.Captures) == 0 {
+		return "", true, nil
+	}
+
+	return g.String(), true, nil
+}
+
+// stepName returns a human readable name for a step in logs
+func stepName(step Step) string {
+	for _, name := range []string{step.Label, step.Group, step.Key, step.Trigger} {
+		if name != "" {
+			return name
+		}
+	}
+
+	if command, ok := isString(step.Command); ok {
+		return command
+	}
+
+	return "unnamed step"
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestExpandMatrixFromMatchedDirs(t *testing.T) {
+	w := WatchConfig{
+		Paths: []string{"packages/"},
+		Depth: 2,
+		Steps: []Step{{
+			Label:   "Test {{matrix}}",
+			Command: "make -C {{matrix}} test",
+			Matrix:  map[string]interface{}{"from_matched": "dir"},
+		}},
+	}
+
+	steps, err := stepsToTrigger([]string{"packages/b/main.go", "packages/a/main.go", "packages/a/go.mod"}, Plugin{Watch: []WatchConfig{w}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []Step{{
+		Label:   "Test {{matrix}}",
+		Command: "make -C {{matrix}} test",
+		Matrix:  map[string]interface{}{"setup": []interface{}{"packages/a", "packages/b"}},
+	}}, steps)
+
+	// the placeholder in the watch config is left in place for later builds
+	assert.Equal(t, map[string]interface{}{"from_matched": "dir"}, w.Steps[0].Matrix)
+}
+
+func TestExpandMatrixFromCaptureGroup(t *testing.T) {
+	w := WatchConfig{
+		Paths:      []string{`^services/(?<service>[^/]+)/`},
+		RegexPaths: true,
+		Steps: []Step{{
+			Command: "test.sh",
+			Matrix: map[string]interface{}{
+				"from_matched":  "capture",
+				"capture_group": "service",
+				"dimension":     "service",
+				"setup":         map[string]interface{}{"os": []interface{}{"linux", "windows"}},
+				"adjustments":   []interface{}{map[string]interface{}{"with": map[string]interface{}{"os": "windows", "service": "api"}, "skip": true}},
+			},
+		}},
+	}
+
+	steps, err := expandMatrixSteps(w.Steps, w, []string{"services/web/a.ts", "services/api/b.go"})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"setup": map[string]interface{}{
+			"os":      []interface{}{"linux", "windows"},
+			"service": []interface{}{"api", "web"},
+		},
+		"adjustments": []interface{}{map[string]interface{}{"with": map[string]interface{}{"os": "windows", "service": "api"}, "skip": true}},
+	}, steps[0].Matrix)
+}
+
+func TestExpandMatrixSplitsLargeMatrices(t *testing.T) {
+	var files []string
+	for i := 0; i < 45; i++ {
+		files = append(files, fmt.Sprintf("packages/p%02d/main.go", i))
+	}
+
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+
+	w := WatchConfig{
+		Name:  "packages",
+		Paths: []string{"packages/"},
+		Depth: 2,
+		Steps: []Step{{
+			Label:   "Test",
+			Key:     "test",
+			Command: "make test",
+			Matrix:  map[string]interface{}{"from_matched": "dir"},
+		}},
+	}
+
+	steps, err := expandMatrixSteps(w.Steps, w, files)
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	assert.Equal(t, `Split matrix of step "Test" into 3 steps of up to 20 values`, hook.LastEntry().Message)
+	assert.Equal(t, "packages", hook.LastEntry().Data["watch"])
+
+	// the chunks are grouped under the original key so depends_on still works
+	group := steps[0]
+	assert.Equal(t, "Test", group.Group)
+	assert.Equal(t, "test", group.Key)
+	require.Len(t, group.Steps, 3)
+
+	assert.Equal(t, "test-1", group.Steps[0].Key)
+	assert.Equal(t, "Test (1/3)", group.Steps[0].Label)
+	assert.Len(t, group.Steps[0].Matrix.(map[string]interface{})["setup"], 20)
+	assert.Equal(t, "test-3", group.Steps[2].Key)
+	assert.Len(t, group.Steps[2].Matrix.(map[string]interface{})["setup"], 5)
+
+	out, err := yaml.Marshal(group)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "group: Test\nkey: test\nsteps:\n")
+}
+
+func TestExpandMatrixRespectsOtherDimensions(t *testing.T) {
+	var files []string
+	for i := 0; i < 10; i++ {
+		files = append(files, fmt.Sprintf("packages/p%d/main.go", i))
+	}
+
+	w := WatchConfig{
+		Paths: []string{"packages/"},
+		Depth: 2,
+		Steps: []Step{{
+			Group: "Tests",
+			Steps: []Step{{
+				Command: "make test",
+				Matrix: map[string]interface{}{
+					"from_matched": "dir",
+					"dimension":    "package",
+					"setup":        map[string]interface{}{"os": []interface{}{"linux", "macos", "windows", "freebsd", "openbsd", "netbsd"}},
+				},
+			}},
+		}},
+	}
+
+	steps, err := expandMatrixSteps(w.Steps, w, files)
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+
+	// 6 os values leave room for 8 packages per matrix within 50 jobs, and
+	// nested steps are split in place as groups can't be nested
+	require.Len(t, steps[0].Steps, 2)
+	setup := steps[0].Steps[0].Matrix.(map[string]interface{})["setup"].(map[string]interface{})
+	assert.Len(t, setup["package"], 8)
+}
+
+func TestExpandMatrixErrorsWhenOtherDimensionsAreTooLarge(t *testing.T) {
+	values := make([]interface{}, 51)
+	for i := range values {
+		values[i] = fmt.Sprint(i)
+	}
+
+	w := WatchConfig{
+		Paths: []string{"packages/"},
+		Steps: []Step{{
+			Label:   "Test",
+			Command: "make test",
+			Matrix: map[string]interface{}{
+				"from_matched": "dir",
+				"dimension":    "package",
+				"setup":        map[string]interface{}{"shard": values},
+			},
+		}},
+	}
+
+	_, err := expandMatrixSteps(w.Steps, w, []string{"packages/a/main.go"})
+	assert.EqualError(t, err, `matrix of step "Test" has 51 jobs before adding matched values, more than the 50 Buildkite allows`)
+}
+
+func TestPluginValidatesMatrixPlaceholder(t *testing.T) {
+	testCases := map[string]struct {
+		Watch string
+		Error string
+	}{
+		"unknown source": {
+			Watch: `{"path": "a/", "config": {"command": "x", "matrix": {"from_matched": "file"}}}`,
+			Error: `unsupported matrix from_matched value "file", expected "dir" or "capture"`,
+		},
+		"capture without regex": {
+			Watch: `{"path": "a/", "config": {"command": "x", "matrix": {"from_matched": "capture"}}}`,
+			Error: "matrix from_matched: capture requires regex_paths",
+		},
+		"setup without dimension": {
+			Watch: `{"path": "a/", "config": {"command": "x", "matrix": {"from_matched": "dir", "setup": {"os": ["linux"]}}}}`,
+			Error: "matrix from_matched with other setup dimensions requires a dimension name",
+		},
+		"default": {
+			Watch: `{"default": {"command": "x", "matrix": {"from_matched": "dir"}}}`,
+			Error: "matrix from_matched is not supported in default, always or uncovered config",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			param := `[{"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {"watch": [` + tc.Watch + `]}}]`
+
+			_, err := initializePlugin(param)
+			assert.EqualError(t, err, tc.Error)
+		})
+	}
+}
+
+func TestRenderStringLeavesBuildkiteMatrixReferences(t *testing.T) {
+	got, err := renderString("command", "make -C {{.Dir}} {{matrix}} {{ matrix.os }}", templateData{Dir: "api"})
+	require.NoError(t, err)
+	assert.Equal(t, "make -C api {{matrix}} {{ matrix.os }}", got)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Strategies for duplicate_steps, applied to steps that share a key, or
+// trigger steps without a key that trigger the same pipeline
+const (
+	// duplicateFirstWins keeps the first step and drops the others
+	duplicateFirstWins = "first-wins"
+	// duplicateMerge keeps the first step, adding the env, build env and
+	// build meta-data of the others
+	duplicateMerge = "merge"
+	// duplicateError fails the upload
+	duplicateError = "error"
+)
+
+// dedupSteps merges duplicate steps into the first of them, combining the
+// files and watches that caused them. Identical steps are always merged;
+// steps with the same identity are merged according to strategy. Keys
+// given by linkWatches are left out of the comparison, and the references
+// to the key of a merged step are updated to the step it was merged into.
+func dedupSteps(steps []generatedStep, strategy string) ([]generatedStep, error) {
+	unique := []generatedStep{}
+	byContent := map[string]int{}
+	byIdentity := map[string]int{}
+	renamed := map[string]string{}
+
+	for _, s := range steps {
+		// wait steps separate the steps around them, so are all kept
+		if s.Step.Wait != nil {
+			unique = append(unique, s)
+			continue
+		}
+
+		compared := s.Step
+		if s.AutoKey {
+			compared.Key = ""
+		}
+
+		content, err := yaml.Marshal(compared)
+		if err != nil {
+			return nil, fmt.Errorf("could not compare step %q: %v", stepName(s.Step), err)
+		}
+
+		if i, ok := byContent[string(content)]; ok {
+			log.WithField("phase", phaseGenerate).Infof("Merged identical step %q from %s into the step from %s", stepName(compared), describeWatches(s.Watches), describeWatches(unique[i].Watches))
+
+			keepAutoKey(&unique[i], s, renamed)
+			unique[i].Files = mergeFiles(unique[i].Files, s.Files)
+			unique[i].Watches = mergeFiles(unique[i].Watches, s.Watches)
+			continue
+		}
+
+		id := stepIdentity(compared)
+		if i, ok := byIdentity[id]; ok && strategy != "" {
+			if strategy == duplicateError {
+				return nil, fmt.Errorf("duplicate step %s generated by %s and %s", describeIdentity(compared), describeWatches(unique[i].Watches), describeWatches(s.Watches))
+			}
+
+			log.WithField("phase", phaseGenerate).Infof("Merged step %s from %s into the step from %s (%s)", describeIdentity(compared), describeWatches(s.Watches), describeWatches(unique[i].Watches), strategy)
+
+			if strategy == duplicateMerge {
+				unique[i].Step = mergeStep(unique[i].Step, s.Step)
+			}
+			keepAutoKey(&unique[i], s, renamed)
+			unique[i].Files = mergeFiles(unique[i].Files, s.Files)
+			unique[i].Watches = mergeFiles(unique[i].Watches, s.Watches)
+			continue
+		}
+
+		byContent[string(content)] = len(unique)
+		if _, ok := byIdentity[id]; !ok && id != "" {
+			byIdentity[id] = len(unique)
+		}
+		unique = append(unique, s)
+	}
+
+	if len(renamed) > 0 {
+		for i := range unique {
+			unique[i].Step = renameDependencies(unique[i].Step, renamed)
+		}
+	}
+
+	return unique, nil
+}
+
+// keepAutoKey gives kept the key linkWatches gave merged, so the steps that
+// depend on it still resolve, or records in renamed that the key now
+// refers to the key kept already has
+func keepAutoKey(kept *generatedStep, merged generatedStep, renamed map[string]string) {
+	if !merged.AutoKey {
+		return
+	}
+
+	if kept.Step.Key == "" {
+		kept.Step.Key = merged.Step.Key
+		kept.AutoKey = true
+	} else if kept.Step.Key != merged.Step.Key {
+		renamed[merged.Step.Key] = kept.Step.Key
+	}
+}
+
+// stepIdentity returns what makes two steps the same step regardless of
+// their other attributes: the step key, or the pipeline a trigger step
+// without a key triggers. Other steps have no identity.
+func stepIdentity(step Step) string {
+	if step.Key != "" {
+		return "key:" + step.Key
+	}
+
+	if step.Trigger != "" {
+		return "trigger:" + step.Trigger
+	}
+
+	return ""
+}
+
+// describeIdentity returns the identity of step for logs and errors, with
+// its key or trigger as written in the config
+func describeIdentity(step Step) string {
+	if step.Key != "" {
+		return fmt.Sprintf("with key %q", step.Key)
+	}
+
+	return fmt.Sprintf("triggering %q", step.Trigger)
+}
+
+// mergeStep returns a copy of step with the env, build env and build
+// meta-data of other added. Values step already sets are kept.
+func mergeStep(step, other Step) Step {
+	id := describeIdentity(step)
+	step.Env = mergeValues(id, "env", step.Env, other.Env)
+	step.Build.Env = mergeValues(id, "build.env", step.Build.Env, other.Build.Env)
+	step.Build.Metadata = mergeValues(id, "build.meta_data", step.Build.Metadata, other.Build.Metadata)
+
+	return step
+}
+
+func mergeValues(id, field string, values, other map[string]string) map[string]string {
+	merged := values
+	for k, v := range other {
+		if existing, ok := values[k]; ok && existing != v {
+			log.WithField("phase", phaseGenerate).Warnf("Merging step %s: keeping %s %s=%q over %q", id, field, k, existing, v)
+		}
+		merged = withEnv(merged, k, v)
+	}
+
+	return merged
+}
+
+// describeWatches returns the watch names for logs
+func describeWatches(names []string) string {
+	if len(names) == 0 {
+		return "an unnamed watch"
+	}
+
+	if len(names) == 1 {
+		return "watch " + names[0]
+	}
+
+	return "watches " + strings.Join(names, ", ")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupStepsMergesIdenticalSteps(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+
+	steps := []generatedStep{
+		{Step: Step{Trigger: "deploy"}, Files: []string{"api/a.go"}, Watches: []string{"api"}},
+		{Step: Step{Command: "lint"}, Files: []string{"web/b.ts"}},
+		{Step: Step{Trigger: "deploy"}, Files: []string{"lib/c.go"}, Watches: []string{"lib"}},
+		{Step: Step{Trigger: "deploy", Env: map[string]string{"FOO": "bar"}}, Files: []string{"cli/d.go"}},
+		{Step: Step{Wait: &WaitStep{}}},
+		{Step: Step{Wait: &WaitStep{}}},
+	}
+
+	got, err := dedupSteps(steps, "")
+	require.NoError(t, err)
+
+	// without a strategy only identical steps are merged
+	assert.Equal(t, []generatedStep{
+		{Step: Step{Trigger: "deploy"}, Files: []string{"api/a.go", "lib/c.go"}, Watches: []string{"api", "lib"}},
+		{Step: Step{Command: "lint"}, Files: []string{"web/b.ts"}},
+		{Step: Step{Trigger: "deploy", Env: map[string]string{"FOO": "bar"}}, Files: []string{"cli/d.go"}},
+		{Step: Step{Wait: &WaitStep{}}},
+		{Step: Step{Wait: &WaitStep{}}},
+	}, got)
+
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, `Merged identical step "deploy" from watch lib into the step from watch api`, hook.LastEntry().Message)
+}
+
+func TestDedupStepsStrategies(t *testing.T) {
+	steps := []generatedStep{
+		{Step: Step{Trigger: "deploy", Build: Build{Env: map[string]string{"SERVICE": "api"}}}, Files: []string{"api/a.go"}, Watches: []string{"api"}},
+		{Step: Step{Command: "make", Key: "build", Env: map[string]string{"TARGET": "api"}}, Files: []string{"api/a.go"}, Watches: []string{"api"}},
+		{Step: Step{Trigger: "deploy", Build: Build{Env: map[string]string{"SERVICE": "lib", "LIB": "1"}, Metadata: map[string]string{"lib": "true"}}}, Files: []string{"lib/b.go"}, Watches: []string{"lib"}},
+		{Step: Step{Command: "make all", Key: "build", Env: map[string]string{"VERBOSE": "1"}}, Files: []string{"lib/b.go"}, Watches: []string{"lib"}},
+		{Step: Step{Trigger: "docs", Key: "deploy"}, Files: []string{"docs/c.md"}, Watches: []string{"docs"}},
+	}
+
+	got, err := dedupSteps(steps, duplicateFirstWins)
+	require.NoError(t, err)
+	assert.Equal(t, []generatedStep{
+		{Step: steps[0].Step, Files: []string{"api/a.go", "lib/b.go"}, Watches: []string{"api", "lib"}},
+		{Step: steps[1].Step, Files: []string{"api/a.go", "lib/b.go"}, Watches: []string{"api", "lib"}},
+		steps[4],
+	}, got)
+
+	got, err = dedupSteps(steps, duplicateMerge)
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	assert.Equal(t, Step{
+		Trigger: "deploy",
+		Build: Build{
+			Env:      map[string]string{"SERVICE": "api", "LIB": "1"},
+			Metadata: map[string]string{"lib": "true"},
+		},
+	}, got[0].Step)
+	assert.Equal(t, Step{Command: "make", Key: "build", Env: map[string]string{"TARGET": "api", "VERBOSE": "1"}}, got[1].Step)
+	assert.Equal(t, map[string]string{"SERVICE": "api"}, steps[0].Step.Build.Env)
+
+	_, err = dedupSteps(steps[1:4], duplicateError)
+	assert.EqualError(t, err, `duplicate step with key "build" generated by watch api and watch lib`)
+
+	_, err = dedupSteps(steps, duplicateError)
+	assert.EqualError(t, err, `duplicate step triggering "deploy" generated by watch api and watch lib`)
+}
+
+func TestDuplicateStepsValidation(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"duplicate_steps": "last-wins",
+			"watch": [{ "path": "foo", "config": { "command": "echo foo" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, `unsupported duplicate_steps value "last-wins", expected "first-wins", "merge" or "error"`)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Results recorded in build meta-data, named after the key they're
+// recorded under without the prefix
+const (
+	resultWatches      = "watches"
+	resultTriggers     = "triggers"
+	resultChangedFiles = "changed_files"
+	resultDiffBase     = "diff_base"
+)
+
+// results are the recorded results, in the order they're set
+var results = []string{resultWatches, resultTriggers, resultChangedFiles, resultDiffBase}
+
+// ResultMetadata configures the build meta-data the results of the diff
+// are recorded in
+type ResultMetadata struct {
+	// Prefix namespaces the keys of the results
+	Prefix string `json:"prefix"`
+	// Keys replaces the keys of some results
+	Keys map[string]string `json:"keys"`
+}
+
+// validate checks Keys only names known results
+func (m ResultMetadata) validate() error {
+	for name := range m.Keys {
+		if !slices.Contains(results, name) {
+			return fmt.Errorf("unsupported record_meta_data key %q, expected %q, %q, %q or %q", name, resultWatches, resultTriggers, resultChangedFiles, resultDiffBase)
+		}
+	}
+
+	return nil
+}
+
+// key returns the meta-data key a result is recorded under, e.g.
+// "monorepo-diff-changed-files" for changed_files with the default prefix
+func (m ResultMetadata) key(result string) string {
+	if key, ok := m.Keys[result]; ok {
+		return key
+	}
+
+	return m.Prefix + strings.ReplaceAll(result, "_", "-")
+}
+
+// values returns the results of s keyed by meta-data key, leaving out
+// empty ones as meta-data values can't be empty
+func (m ResultMetadata) values(s summary) map[string]string {
+	watches := []string{}
+	for _, w := range s.Watches {
+		if w.Matched && w.Name != "" {
+			watches = append(watches, w.Name)
+		}
+	}
+
+	values := map[string]string{
+		m.key(resultWatches):      strings.Join(watches, "\n"),
+		m.key(resultTriggers):     strings.Join(triggers(s.Steps), "\n"),
+		m.key(resultChangedFiles): strconv.Itoa(len(s.Files)),
+		m.key(resultDiffBase):     s.DiffBase,
+	}
+
+	for k, v := range values {
+		if v == "" {
+			delete(values, k)
+		}
+	}
+
+	return values
+}
+
+// recordMetadata sets the build meta-data of the results of s
+func recordMetadata(s summary, m ResultMetadata) error {
+	values := m.values(s)
+
+	for _, result := range results {
+		key := m.key(result)
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+
+		log.WithField("phase", phaseUpload).Debugf("Setting meta-data %s to %q", key, value)
+		if _, err := executeCommand("buildkite-agent", []string{"meta-data", "set", key, value}); err != nil {
+			return fmt.Errorf("could not set meta-data %s: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// triggers returns the pipelines triggered by steps, in order and without
+// repeats
+func triggers(steps []Step) []string {
+	slugs := []string{}
+	for _, step := range steps {
+		if step.Trigger != "" && !slices.Contains(slugs, step.Trigger) {
+			slugs = append(slugs, step.Trigger)
+		}
+		for _, slug := range triggers(step.Steps) {
+			if !slices.Contains(slugs, slug) {
+				slugs = append(slugs, slug)
+			}
+		}
+	}
+
+	return slugs
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultMetadataValues(t *testing.T) {
+	s := summary{
+		DiffBase: "abc123",
+		Files:    []string{"services/api/main.go", "services/web/index.js"},
+		Watches: []watchResult{
+			{Name: "api", Matched: true},
+			{Name: "web", Matched: true},
+			{Name: "docs"},
+		},
+		Steps: []Step{
+			{Trigger: "api-deploy"},
+			{Group: "web", Steps: []Step{{Trigger: "web-deploy"}, {Trigger: "api-deploy"}}},
+			{Command: "make"},
+		},
+	}
+
+	m := ResultMetadata{Prefix: metadataPrefix}
+	assert.Equal(t, map[string]string{
+		"monorepo-diff-watches":       "api\nweb",
+		"monorepo-diff-triggers":      "api-deploy\nweb-deploy",
+		"monorepo-diff-changed-files": "2",
+		"monorepo-diff-diff-base":     "abc123",
+	}, m.values(s))
+
+	m = ResultMetadata{Prefix: "services-", Keys: map[string]string{"diff_base": "base-commit"}}
+	assert.Equal(t, map[string]string{
+		"services-watches":       "api\nweb",
+		"services-triggers":      "api-deploy\nweb-deploy",
+		"services-changed-files": "2",
+		"base-commit":            "abc123",
+	}, m.values(s))
+}
+
+func TestResultMetadataValuesLeavesOutEmptyValues(t *testing.T) {
+	m := ResultMetadata{Prefix: metadataPrefix}
+	assert.Equal(t, map[string]string{"monorepo-diff-changed-files": "0"}, m.values(summary{}))
+}
+
+func TestUploadPipelineRecordsMetadataWithoutSteps(t *testing.T) {
+	plugin := Plugin{
+		Diff:           "echo README.md",
+		DiffBase:       "abc123",
+		RecordMetadata: &ResultMetadata{Prefix: metadataPrefix},
+		Watch:          []WatchConfig{{Name: "api", Paths: []string{"services/api/"}, Steps: []Step{{Command: "make api"}}}},
+	}
+
+	agent, err := bintest.NewMock("buildkite-agent")
+	require.NoError(t, err)
+
+	oldPath := os.Getenv("PATH")
+	t.Cleanup(func() { _ = os.Setenv("PATH", oldPath) })
+	_ = os.Setenv("PATH", filepath.Dir(agent.Path)+":"+oldPath)
+
+	agent.
+		Expect("meta-data", "set", "monorepo-diff-changed-files", "1").
+		AndExitWith(0)
+	agent.
+		Expect("meta-data", "set", "monorepo-diff-diff-base", "abc123").
+		AndExitWith(0)
+
+	uploader := &recordingUploader{}
+	err = uploadPipeline(plugin, generatePipeline, uploader)
+	assert.NoError(t, err)
+	assert.Empty(t, uploader.pipelines)
+
+	require.NoError(t, agent.CheckAndClose(t))
+}
+
+func TestUploadPipelineFailsWhenMetadataCannotBeSet(t *testing.T) {
+	plugin := Plugin{
+		Diff:           "echo",
+		RecordMetadata: &ResultMetadata{Prefix: metadataPrefix},
+	}
+
+	agent, err := bintest.NewMock("buildkite-agent")
+	require.NoError(t, err)
+
+	oldPath := os.Getenv("PATH")
+	t.Cleanup(func() { _ = os.Setenv("PATH", oldPath) })
+	_ = os.Setenv("PATH", filepath.Dir(agent.Path)+":"+oldPath)
+
+	agent.
+		Expect("meta-data", "set", "monorepo-diff-changed-files", "0").
+		AndExitWith(1)
+
+	err = uploadPipeline(plugin, generatePipeline, &recordingUploader{})
+	assert.ErrorContains(t, err, "could not set meta-data monorepo-diff-changed-files")
+
+	require.NoError(t, agent.CheckAndClose(t))
+}
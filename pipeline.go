@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -14,19 +13,66 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// Values of on_empty_diff, choosing the steps generated when the diff finds
+// no changes
+const (
+	// onEmptyDiffSkip generates no steps and uploads nothing
+	onEmptyDiffSkip = "skip"
+	// onEmptyDiffDefault generates the default and always configs
+	onEmptyDiffDefault = "default"
+	// onEmptyDiffAll generates the steps of every watch as if it matched
+	onEmptyDiffAll = "all"
+)
+
 // WaitStep represents a Buildkite Wait Step
 // https://buildkite.com/docs/pipelines/wait-step
 // We can't use Step here since the value for Wait is always nil
 // regardless of whether or not we want to include the key.
-type WaitStep struct{}
+type WaitStep struct {
+	ContinueOnFailure      bool        `json:"continue_on_failure"`
+	Key                    string      `json:"key"`
+	Condition              string      `json:"if"`
+	DependsOn              interface{} `json:"depends_on"`
+	AllowDependencyFailure bool        `json:"allow_dependency_failure"`
+	Branches               interface{} `json:"branches"`
+	// Extra holds the attributes WaitStep doesn't model, passed through as is
+	Extra map[string]interface{} `json:"-"`
+}
 
-func (WaitStep) MarshalYAML() (interface{}, error) {
-	return map[string]interface{}{
-		"wait": nil,
+func (w WaitStep) MarshalYAML() (interface{}, error) {
+	return struct {
+		Wait                   *string                `yaml:"wait"`
+		ContinueOnFailure      bool                   `yaml:"continue_on_failure,omitempty"`
+		Key                    string                 `yaml:"key,omitempty"`
+		Condition              string                 `yaml:"if,omitempty"`
+		DependsOn              interface{}            `yaml:"depends_on,omitempty"`
+		AllowDependencyFailure bool                   `yaml:"allow_dependency_failure,omitempty"`
+		Branches               interface{}            `yaml:"branches,omitempty"`
+		Extra                  map[string]interface{} `yaml:",inline"`
+	}{
+		ContinueOnFailure:      w.ContinueOnFailure,
+		Key:                    w.Key,
+		Condition:              w.Condition,
+		DependsOn:              w.DependsOn,
+		AllowDependencyFailure: w.AllowDependencyFailure,
+		Branches:               w.Branches,
+		Extra:                  w.Extra,
 	}, nil
 }
 
 func (s Step) MarshalYAML() (interface{}, error) {
+	if s.Wait != nil {
+		return WaitStep{
+			ContinueOnFailure:      s.Wait.ContinueOnFailure,
+			Key:                    s.Key,
+			Condition:              s.Condition,
+			DependsOn:              s.DependsOn,
+			AllowDependencyFailure: s.AllowDependencyFailure,
+			Branches:               s.Branches,
+			Extra:                  s.Extra,
+		}, nil
+	}
+
 	if s.Group == "" {
 		type Alias Step
 		return (Alias)(s), nil
@@ -38,6 +84,7 @@ func (s Step) MarshalYAML() (interface{}, error) {
 	condition := s.Condition
 	notify := s.Notify
 	allowDependencyFailure := s.AllowDependencyFailure
+	var extra map[string]interface{}
 
 	s.Group = ""
 	s.Key = ""
@@ -46,9 +93,12 @@ func (s Step) MarshalYAML() (interface{}, error) {
 	s.Notify = nil
 	s.AllowDependencyFailure = false
 
+	// attributes the plugin doesn't model belong to the group when it has
+	// nested steps, otherwise to the single step wrapped in it
 	stps := []Step{s}
 	if s.Steps != nil {
 		stps = s.Steps
+		extra = s.Extra
 	}
 	return Group{
 		Label:                  label,
@@ -58,6 +108,7 @@ func (s Step) MarshalYAML() (interface{}, error) {
 		Condition:              condition,
 		Notify:                 notify,
 		AllowDependencyFailure: allowDependencyFailure,
+		Extra:                  extra,
 	}, nil
 }
 
@@ -69,54 +120,146 @@ func (n PluginNotify) MarshalYAML() (interface{}, error) {
 // PipelineGenerator generates pipeline file
 type PipelineGenerator func(steps []Step, plugin Plugin) (*os.File, bool, error)
 
-func uploadPipeline(plugin Plugin, generatePipeline PipelineGenerator) (string, []string, error) {
-	diffOutput, err := diff(plugin.Diff)
+// uploadPipeline generates the pipeline of the steps the diff triggers and
+// uploads it with uploader
+func uploadPipeline(plugin Plugin, generatePipeline PipelineGenerator, uploader Uploader) error {
+	result, skip, err := diffSteps(&plugin)
 	if err != nil {
-		log.Fatal(err)
-		return "", []string{}, err
+		return err
 	}
 
-	if len(diffOutput) < 1 {
-		log.Info("No changes detected. Skipping pipeline upload.")
-		return "", []string{}, nil
+	if plugin.RecordMetadata != nil {
+		if err := recordMetadata(result, *plugin.RecordMetadata); err != nil {
+			return withExitCode(exitUpload, err)
+		}
+	}
+
+	if skip {
+		return nil
 	}
+	steps := result.Steps
 
-	log.Debug("Output from diff: \n" + strings.Join(diffOutput, "\n"))
+	if plugin.Annotate != nil {
+		annotate(result, *plugin.Annotate)
+	}
+
+	if plugin.FailOnNoMatch && len(steps) == 0 {
+		return withExitCode(exitNoMatch, fmt.Errorf("no steps generated for %d changed files", len(result.Files)))
+	}
 
-	steps, err := stepsToTrigger(diffOutput, plugin.Watch)
+	if plugin.passesFiles() {
+		steps, err = uploadMatchedFiles(steps, plugin.Interpolation)
+		if err != nil {
+			return withExitCode(exitUpload, err)
+		}
+	}
+
+	chunks, err := splitSteps(steps, plugin)
 	if err != nil {
-		return "", []string{}, err
+		return withExitCode(exitGenerate, err)
+	}
+	if len(chunks) > 1 {
+		log.WithField("phase", phaseUpload).Infof("Splitting %d steps into %d pipeline uploads", len(steps), len(chunks))
+	}
+
+	for i, chunk := range chunks {
+		chunkPlugin := plugin
+		if i < len(chunks)-1 {
+			// the wait step, hooks and notifications come after every step
+			chunkPlugin.Wait, chunkPlugin.Hooks, chunkPlugin.Notify = false, nil, nil
+		}
+		if i > 0 {
+			uploader = appendingUploader(uploader)
+			log.WithField("phase", phaseUpload).Infof("Uploading pipeline %d of %d", i+1, len(chunks))
+		}
+
+		if err := uploadChunk(chunk, chunkPlugin, generatePipeline, uploader); err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+// uploadChunk generates the pipeline of steps and uploads it with uploader
+func uploadChunk(steps []Step, plugin Plugin, generatePipeline PipelineGenerator, uploader Uploader) error {
 	pipeline, hasSteps, err := generatePipeline(steps, plugin)
 	if err != nil {
-		return "", []string{}, err
+		return withExitCode(exitGenerate, err)
 	}
 	defer func() {
 		if removeErr := os.Remove(pipeline.Name()); removeErr != nil {
-			log.Errorf("Failed to remove temporary pipeline file: %v", removeErr)
+			log.WithField("phase", phaseUpload).Errorf("Failed to remove temporary pipeline file: %v", removeErr)
 		}
 	}()
 
 	if !hasSteps {
-		log.Info("No steps generated. Skipping pipeline upload.")
-		return "", []string{}, nil
+		log.WithField("phase", phaseUpload).Info("No steps generated. Skipping pipeline upload.")
+		return nil
+	}
+
+	return withExitCode(exitUpload, uploader.Upload(pipeline.Name()))
+}
+
+// diffSteps runs the diff command of plugin, resolving its diff base, and
+// returns the summary of the steps the changed files trigger. skip is true
+// when the diff finds no changes and on_empty_diff generates no steps for
+// them.
+func diffSteps(plugin *Plugin) (summary, bool, error) {
+	diffOutput, err := diff(plugin.Diff)
+	if err != nil {
+		return summary{}, false, withExitCode(exitDiff, err)
+	}
+
+	base := plugin.DiffBase
+	if base == "" {
+		base = diffBaseRef(plugin.Diff)
+	}
+	plugin.DiffBase = resolveCommit(base)
+
+	if len(diffOutput) < 1 {
+		if plugin.OnEmptyDiff == "" || plugin.OnEmptyDiff == onEmptyDiffSkip {
+			log.WithField("phase", phaseDiff).Info("No changes detected. Skipping pipeline upload.")
+			return summary{DiffBase: plugin.DiffBase, Files: diffOutput}, true, nil
+		}
+		log.WithField("phase", phaseDiff).Infof("No changes detected. Generating %s steps.", plugin.OnEmptyDiff)
 	}
 
-	cmd := "buildkite-agent"
-	args := []string{"pipeline", "upload", pipeline.Name()}
+	log.WithField("phase", phaseDiff).Debug("Output from diff: \n" + strings.Join(diffOutput, "\n"))
+
+	result, err := summarize(diffOutput, *plugin)
+
+	return result, false, withExitCode(exitGenerate, err)
+}
 
-	if !plugin.Interpolation {
-		args = append(args, "--no-interpolation")
+// uploadMatchedFiles uploads the matched files lists too large to pass in
+// the env of steps as artifacts, so steps can download them when they run,
+// returning the steps prepared for upload
+func uploadMatchedFiles(steps []Step, interpolation bool) ([]Step, error) {
+	steps, artifacts, err := prepareMatchedFiles(steps, interpolation)
+	defer func() {
+		for _, artifact := range artifacts {
+			if removeErr := os.Remove(artifact); removeErr != nil {
+				log.WithField("phase", phaseUpload).Errorf("Failed to remove matched files list: %v", removeErr)
+			}
+		}
+	}()
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = executeCommand("buildkite-agent", args)
+	for _, artifact := range artifacts {
+		log.WithField("phase", phaseUpload).Infof("Uploading matched files list %s as an artifact", artifact)
+		if _, err := executeCommand("buildkite-agent", []string{"artifact", "upload", artifact}); err != nil {
+			return nil, err
+		}
+	}
 
-	return cmd, args, err
+	return steps, nil
 }
 
 func diff(command string) ([]string, error) {
-	log.Infof("Running diff command: %s", command)
+	log.WithField("phase", phaseDiff).Infof("Running diff command: %s", command)
 
 	output, err := executeCommand(
 		env("SHELL", "bash"),
@@ -126,10 +269,15 @@ func diff(command string) ([]string, error) {
 		return nil, fmt.Errorf("diff command failed: %v", err)
 	}
 
+	return parseDiffOutput(output), nil
+}
+
+// parseDiffOutput returns the paths listed in the output of a diff command
+func parseDiffOutput(output string) []string {
 	hasNewlines := strings.ContainsRune(output, '\n')
 	output = strings.TrimRight(output, "\n")
 	if output == "" {
-		return []string{}, nil
+		return []string{}
 	}
 
 	var fields []string
@@ -162,7 +310,51 @@ func diff(command string) ([]string, error) {
 		}
 	}
 
-	return paths, nil
+	return paths
+}
+
+// diffBaseRef returns the revision a `git diff` command compares against,
+// or an empty string for custom diff commands where it can't be known.
+func diffBaseRef(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) < 2 || fields[0] != "git" || fields[1] != "diff" {
+		return ""
+	}
+
+	for _, arg := range fields[2:] {
+		if arg == "--" || strings.ContainsAny(arg, "$`(") {
+			return ""
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+	}
+
+	return ""
+}
+
+// resolveCommit resolves a revision to a commit SHA, falling back to the
+// revision as given when git can't resolve it. Symmetric `a...b` ranges
+// resolve to their merge base and `a..b` ranges to `a`, matching git diff.
+func resolveCommit(rev string) string {
+	if rev == "" {
+		return ""
+	}
+
+	args := []string{"rev-parse", "--verify", "--quiet", rev + "^{commit}"}
+	if from, to, ok := strings.Cut(rev, "..."); ok {
+		args = []string{"merge-base", from, to}
+	} else if from, _, ok := strings.Cut(rev, ".."); ok {
+		args = []string{"rev-parse", "--verify", "--quiet", from + "^{commit}"}
+	}
+
+	out, err := executeCommand("git", args)
+	if err != nil {
+		log.WithField("phase", phaseDiff).Debugf("could not resolve diff base %s: %v", rev, err)
+		return rev
+	}
+
+	return strings.TrimSpace(out)
 }
 
 // filterValidSteps splits steps into valid and invalid
@@ -180,98 +372,348 @@ func filterValidSteps(steps []Step) (valid []Step, invalid []Step) {
 	return valid, invalid
 }
 
-// logInvalidStep logs why a step is invalid
-func logInvalidStep(step Step) {
-	context := "empty step configuration"
+// logInvalidStep logs why a step generated by watches is invalid
+func logInvalidStep(step Step, watches []string) {
+	log.WithFields(log.Fields{"phase": phaseGenerate, "watch": strings.Join(watches, ",")}).Warnf("Skipping invalid step from %s: %s. Steps must have at least one of: command, commands, trigger, block, input, or group with nested steps.", describeWatches(watches), invalidStepReason(step))
+}
 
+// invalidStepReason describes why a step is invalid
+func invalidStepReason(step Step) string {
 	if step.Group != "" {
 		if len(step.Steps) == 0 {
-			context = fmt.Sprintf("group '%s' has no valid nested steps", step.Group)
+			return fmt.Sprintf("group '%s' has no valid nested steps", step.Group)
+		}
+		return fmt.Sprintf("group '%s' has invalid nested steps", step.Group)
+	}
+
+	if step.Label != "" {
+		return fmt.Sprintf("step with label '%s' has no command, trigger, block, input, or group", step.Label)
+	}
+
+	if step.Key != "" {
+		return fmt.Sprintf("step with key '%s' has no command, trigger, block, input, or group", step.Key)
+	}
+
+	return "empty step configuration"
+}
+
+func stepsToTrigger(files []string, plugin Plugin) ([]Step, error) {
+	result, err := summarize(files, plugin)
+
+	return result.Steps, err
+}
+
+// summarize returns the steps files trigger, along with why each watch
+// generated steps or not
+func summarize(files []string, plugin Plugin) (summary, error) {
+	result := summary{
+		DiffBase: plugin.DiffBase,
+		Files:    files,
+		Watches:  make([]watchResult, len(plugin.Watch)),
+		Invalid:  []invalidStep{},
+	}
+	perWatch := make([][]generatedStep, len(plugin.Watch))
+	covered := map[string]bool{}
+	matchedAny := false
+
+	matchAll := len(files) == 0 && plugin.OnEmptyDiff == onEmptyDiffAll
+
+	for i, w := range plugin.Watch {
+		logger := log.WithFields(log.Fields{"phase": phaseMatch, "watch": w.Name})
+		result.Watches[i] = watchResult{Name: w.Name}
+		if !w.hasPaths() {
+			continue
+		}
+		matched, err := matchedFiles(w, files)
+		if err != nil {
+			return summary{}, err
+		}
+
+		// files are covered by a watch even when it's excluded this time
+		for _, f := range matched {
+			covered[f] = true
+		}
+
+		if len(matched) == 0 && !matchAll {
+			logger.Debugf("watch %s: no changed files matched", w.Name)
+			result.Watches[i].Reason = "no changed files matched"
+			continue
+		}
+
+		excepted, _, err := exceptedFile(w, files)
+		if err != nil {
+			return summary{}, err
+		}
+		if excepted != "" {
+			logger.WithField("file", excepted).Infof("watch %s: excepted: %s", w.Name, excepted)
+			result.Watches[i].Reason = fmt.Sprintf("excepted: %s", excepted)
+			continue
+		}
+
+		result.Watches[i].Matched = true
+		if matchAll {
+			logger.Infof("watch %s: generating steps for an empty diff", w.Name)
+			result.Watches[i].Reason = "generating steps for an empty diff"
+		} else {
+			logger.Infof("watch %s: %d of %d changed files matched", w.Name, len(matched), len(files))
+			result.Watches[i].Reason = fmt.Sprintf("%d of %d changed files matched", len(matched), len(files))
+		}
+
+		data := templateData{
+			Watch:        w.Name,
+			MatchedFiles: matched,
+			ChangedFiles: files,
+			Branch:       env("BUILDKITE_BRANCH", ""),
+			Commit:       env("BUILDKITE_COMMIT", ""),
+			DiffBase:     plugin.DiffBase,
+		}
+
+		steps, err := watchSteps(w, data, plugin.Templates)
+		if err != nil {
+			return summary{}, fmt.Errorf("watch %s: %v", w.Name, err)
+		}
+
+		// for_each and matrix from_matched expand over the matched files,
+		// which an empty diff doesn't have
+		if matchAll && len(steps) == 0 && len(w.Steps) > 0 {
+			logger.Warnf("watch %s: no matched files to expand for an empty diff, generating no steps", w.Name)
+			result.Watches[i] = watchResult{Name: w.Name, Reason: "no matched files to expand for an empty diff"}
+		}
+		perWatch[i] = steps
+		matchedAny = matchedAny || len(steps) > 0
+	}
+
+	uncovered, err := uncoveredFiles(files, covered, plugin.IgnoreUncovered)
+	if err != nil {
+		return summary{}, err
+	}
+
+	if plugin.FailOnUncovered && len(uncovered) > 0 {
+		return summary{}, withExitCode(exitUncovered, fmt.Errorf("%d changed files are not covered by any watch:\n%s", len(uncovered), strings.Join(uncovered, "\n")))
+	}
+
+	for i, w := range plugin.Watch {
+		logger := log.WithFields(log.Fields{"phase": phaseMatch, "watch": w.Name})
+		switch {
+		case w.Default != nil && !matchedAny:
+			logger.Infof("watch %s: no other watch generated steps, using the default config", w.Name)
+			perWatch[i] = configSteps(w, files, false)
+			result.Watches[i] = watchResult{Name: w.Name, Matched: true, Reason: "no other watch generated steps"}
+		case w.Default != nil:
+			result.Watches[i].Reason = "other watches generated steps"
+		case w.Always != nil:
+			logger.Infof("watch %s: using the always config", w.Name)
+			perWatch[i] = configSteps(w, files, false)
+			result.Watches[i] = watchResult{Name: w.Name, Matched: true, Reason: "always runs"}
+		case w.Uncovered != nil && len(uncovered) > 0:
+			logger.Infof("watch %s: %d of %d changed files matched no watch, using the uncovered config", w.Name, len(uncovered), len(files))
+			perWatch[i] = configSteps(w, uncovered, true)
+			result.Watches[i] = watchResult{Name: w.Name, Matched: true, Reason: fmt.Sprintf("%d of %d changed files matched no watch", len(uncovered), len(files))}
+		case w.Uncovered != nil:
+			result.Watches[i].Reason = "every changed file matched a watch"
+		}
+	}
+
+	if plugin.GroupBy == groupByWatch {
+		for i, w := range plugin.Watch {
+			if perWatch[i], err = groupWatchSteps(perWatch[i], w); err != nil {
+				return summary{}, err
+			}
+		}
+	}
+
+	linkWatches(perWatch, plugin.Watch)
+
+	generated := []generatedStep{}
+	for _, steps := range perWatch {
+		generated = append(generated, steps...)
+	}
+
+	deduped, err := dedupSteps(generated, plugin.DuplicateSteps)
+	if err != nil {
+		return summary{}, err
+	}
+
+	steps := make([]Step, len(deduped))
+	for i, g := range deduped {
+		steps[i] = g.Step
+		if plugin.PassMatchedFiles {
+			steps[i] = withMatchedFiles(steps[i], g.Files)
+		}
+		if plugin.TriggerContext {
+			steps[i] = withTriggerContext(steps[i], triggerContext{
+				Watches:       g.Watches,
+				Files:         g.Files,
+				DiffBase:      plugin.DiffBase,
+				Interpolation: plugin.Interpolation,
+			})
+		}
+	}
+
+	result.Steps = []Step{}
+	for i, step := range steps {
+		if step.isValid() {
+			result.Steps = append(result.Steps, step)
 		} else {
-			context = fmt.Sprintf("group '%s' has invalid nested steps", step.Group)
+			// Log invalid steps with helpful context
+			logInvalidStep(step, deduped[i].Watches)
+			result.Invalid = append(result.Invalid, invalidStep{Watches: deduped[i].Watches, Reason: invalidStepReason(step)})
 		}
-	} else if step.Label != "" {
-		context = fmt.Sprintf("step with label '%s' has no command, trigger, or group", step.Label)
 	}
 
-	log.Warnf("Skipping invalid step: %s. Steps must have at least one of: command, commands, trigger, or group with nested steps.", context)
+	return result, nil
 }
 
-func stepsToTrigger(files []string, watch []WatchConfig) ([]Step, error) {
-	steps := []Step{}
-	var defaultSteps []Step
+// generatedStep is a step generated for a watch along with the changed
+// files that caused it and the names of the watches that generated it
+type generatedStep struct {
+	Step    Step
+	Files   []string
+	Watches []string
+	// AutoKey is set when the key of Step was given by linkWatches
+	AutoKey bool
+}
+
+// watchNames returns the name of w as a list, empty when it has none
+func watchNames(w WatchConfig) []string {
+	if w.Name == "" {
+		return []string{}
+	}
+
+	return []string{w.Name}
+}
 
-	for _, w := range watch {
-		if w.Default != nil {
-			defaultSteps = w.Steps
+// uncoveredFiles returns the files not covered by any watch, leaving out
+// those matching one of the ignore paths
+func uncoveredFiles(files []string, covered map[string]bool, ignore []string) ([]string, error) {
+	uncovered := []string{}
+	for _, f := range files {
+		if covered[f] {
 			continue
 		}
-		except := false
 
-		for _, ex := range w.ExceptPaths {
-			if except {
+		ignored := false
+		for _, p := range ignore {
+			match, err := matchPath(p, f, false)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				ignored = true
 				break
 			}
+		}
 
-			for _, f := range files {
-				exceptMatch, errExcept := matchPath(ex, f, w.RegexPaths)
-				if errExcept != nil {
-					return nil, errExcept
-				}
-				if exceptMatch {
-					log.Printf("excepted: %s\n", f)
-					except = true
-					break
-				}
-			}
+		if !ignored {
+			uncovered = append(uncovered, f)
 		}
+	}
 
-		if except {
-			continue
+	return uncovered, nil
+}
+
+// configSteps returns the steps of a default, always or uncovered config,
+// caused by files. Files are passed to the steps when pass is set.
+func configSteps(w WatchConfig, files []string, pass bool) []generatedStep {
+	generated := []generatedStep{}
+	for _, step := range w.Steps {
+		if pass {
+			step = withMatchedFiles(step, files)
 		}
+		generated = append(generated, generatedStep{Step: step, Files: files, Watches: watchNames(w)})
+	}
 
-		for _, p := range w.Paths {
-			for _, f := range files {
-				match, err := matchPath(p, f, w.RegexPaths)
+	return generated
+}
 
-				skip := false
-				for _, sp := range w.SkipPaths {
-					skipMatch, errSkip := matchPath(sp, f, w.RegexPaths)
+// watchSteps generates the steps of a matched watch, rendering them when
+// templates are enabled or the watch fans out over matched directories
+func watchSteps(w WatchConfig, data templateData, templates bool) ([]generatedStep, error) {
+	copies := []templateData{data}
+	if w.ForEach == forEachMatchedDir {
+		copies = fanOut(data, w.Depth)
+	}
 
-					if errSkip != nil {
-						return nil, errSkip
-					}
+	generated := []generatedStep{}
+	used := map[string]bool{}
+	for _, c := range copies {
+		steps := w.Steps
+		var err error
 
-					if skipMatch {
-						skip = true
-					}
-				}
+		if w.ForEach == forEachMatchedDir {
+			steps, err = fanOutSteps(w.Steps, c, used)
+		} else if templates {
+			steps, err = renderSteps(w.Steps, c)
+		}
+		if err != nil {
+			return nil, err
+		}
 
-				if err != nil {
-					return nil, err
-				}
+		if steps, err = expandMatrixSteps(steps, w, c.MatchedFiles); err != nil {
+			return nil, err
+		}
 
-				if match && !skip {
-					steps = append(steps, w.Steps...)
-					break
-				}
-			}
+		for _, step := range steps {
+			generated = append(generated, generatedStep{Step: step, Files: c.MatchedFiles, Watches: watchNames(w)})
 		}
 	}
 
-	if len(steps) == 0 && defaultSteps != nil {
-		steps = append(steps, defaultSteps...)
+	return generated, nil
+}
+
+// exceptedFile returns the first of files matching one of the watch's
+// except paths, which excludes the whole watch, and that except path, or
+// "" if there is none.
+func exceptedFile(w WatchConfig, files []string) (string, string, error) {
+	for _, ex := range w.ExceptPaths {
+		for _, f := range files {
+			exceptMatch, err := matchPath(ex, f, w.RegexPaths)
+			if err != nil {
+				return "", "", err
+			}
+			if exceptMatch {
+				log.WithFields(log.Fields{"phase": phaseMatch, "watch": w.Name, "file": f, "pattern": ex}).Tracef("%s matches except_path %s", f, ex)
+				return f, ex, nil
+			}
+		}
 	}
 
-	deduped := dedupSteps(steps)
-	valid, invalid := filterValidSteps(deduped)
+	return "", "", nil
+}
 
-	// Log all invalid steps with helpful context
-	for _, step := range invalid {
-		logInvalidStep(step)
+// matchedFiles returns the files that match one of the watch's paths and
+// none of its skip paths.
+func matchedFiles(w WatchConfig, files []string) ([]string, error) {
+	matched := []string{}
+	for _, f := range files {
+		skip := false
+		for _, sp := range w.SkipPaths {
+			skipMatch, err := matchPath(sp, f, w.RegexPaths)
+			if err != nil {
+				return nil, err
+			}
+			if skipMatch {
+				log.WithFields(log.Fields{"phase": phaseMatch, "watch": w.Name, "file": f, "pattern": sp}).Tracef("%s matches skip_path %s", f, sp)
+				skip = true
+			}
+		}
+
+		for _, p := range w.Paths {
+			match, err := matchPath(p, f, w.RegexPaths)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				log.WithFields(log.Fields{"phase": phaseMatch, "watch": w.Name, "file": f, "pattern": p}).Tracef("%s matches path %s", f, p)
+				if !skip {
+					matched = append(matched, f)
+				}
+				break
+			}
+		}
 	}
 
-	return valid, nil
+	return matched, nil
 }
 
 // matchPath checks if the file f matches the path p.
@@ -310,31 +752,28 @@ func matchPath(p string, f string, useRegex bool) (bool, error) {
 	return false, nil
 }
 
-func dedupSteps(steps []Step) []Step {
-	unique := []Step{}
-	for _, p := range steps {
-		duplicate := false
-		for _, t := range unique {
-			if reflect.DeepEqual(p, t) {
-				duplicate = true
-				break
-			}
-		}
-
-		if !duplicate {
-			unique = append(unique, p)
-		}
-	}
-
-	return unique
-}
-
 func generatePipeline(steps []Step, plugin Plugin) (*os.File, bool, error) {
 	tmp, err := os.CreateTemp(os.TempDir(), "bmrd-")
 	if err != nil {
 		return nil, false, fmt.Errorf("could not create temporary pipeline file: %v", err)
 	}
 
+	data, hasSteps, err := marshalPipeline(steps, plugin)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err = os.WriteFile(tmp.Name(), data, 0o644); err != nil {
+		return nil, false, fmt.Errorf("could not write step to temporary file: %v", err)
+	}
+
+	// Returns the temporary file and a boolean indicating whether or not the pipeline has steps
+	return tmp, hasSteps, nil
+}
+
+// marshalPipeline returns the YAML pipeline of steps followed by the wait
+// step, hooks and notifications of plugin, and whether it has any steps
+func marshalPipeline(steps []Step, plugin Plugin) ([]byte, bool, error) {
 	yamlSteps := make([]yaml.Marshaler, len(steps))
 
 	for i, step := range steps {
@@ -342,7 +781,7 @@ func generatePipeline(steps []Step, plugin Plugin) (*os.File, bool, error) {
 	}
 
 	if plugin.Wait {
-		yamlSteps = append(yamlSteps, WaitStep{})
+		yamlSteps = append(yamlSteps, plugin.WaitConfig)
 	}
 
 	for _, cmd := range plugin.Hooks {
@@ -367,19 +806,5 @@ func generatePipeline(steps []Step, plugin Plugin) (*os.File, bool, error) {
 		return nil, false, fmt.Errorf("could not serialize the pipeline: %v", err)
 	}
 
-	// Disable logging in context of go tests.
-	if env("TEST_MODE", "") != "true" {
-		fmt.Printf("Generated Pipeline:\n%s\n", string(data))
-	}
-
-	if err = os.WriteFile(tmp.Name(), data, 0o644); err != nil {
-		return nil, false, fmt.Errorf("could not write step to temporary file: %v", err)
-	}
-
-	// Returns the temporary file and a boolean indicating whether or not the pipeline has steps
-	if len(yamlSteps) == 0 {
-		return tmp, false, nil
-	} else {
-		return tmp, true, nil
-	}
+	return data, len(yamlSteps) > 0, nil
 }
@@ -63,10 +63,7 @@ func TestUploadPipelineCallsBuildkiteAgentCommand(t *testing.T) {
 		Expect("pipeline", "upload", "pipeline.txt").
 		AndExitWith(0)
 
-	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
-
-	assert.Equal(t, "buildkite-agent", cmd)
-	assert.Equal(t, []string{"pipeline", "upload", "pipeline.txt"}, args)
+	err = uploadPipeline(plugin, mockGeneratePipeline, agentUploader{interpolation: plugin.Interpolation})
 	assert.NoError(t, err)
 
 	require.NoError(t, agent.CheckAndClose(t))
@@ -86,10 +83,7 @@ func TestUploadPipelineCallsBuildkiteAgentCommandWithInterpolation(t *testing.T)
 		Expect("pipeline", "upload", "pipeline.txt", "--no-interpolation").
 		AndExitWith(0)
 
-	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
-
-	assert.Equal(t, "buildkite-agent", cmd)
-	assert.Equal(t, []string{"pipeline", "upload", "pipeline.txt", "--no-interpolation"}, args)
+	err = uploadPipeline(plugin, mockGeneratePipeline, agentUploader{interpolation: plugin.Interpolation})
 	assert.NoError(t, err)
 
 	require.NoError(t, agent.CheckAndClose(t))
@@ -97,19 +91,19 @@ func TestUploadPipelineCallsBuildkiteAgentCommandWithInterpolation(t *testing.T)
 
 func TestUploadPipelineCancelsIfThereIsNoDiffOutput(t *testing.T) {
 	plugin := Plugin{Diff: "echo"}
-	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
+	uploader := &recordingUploader{}
+	err := uploadPipeline(plugin, mockGeneratePipeline, uploader)
 
-	assert.Equal(t, "", cmd)
-	assert.Equal(t, []string{}, args)
+	assert.Empty(t, uploader.pipelines)
 	assert.Equal(t, nil, err)
 }
 
 func TestUploadPipelineWithEmptyGeneratedPipeline(t *testing.T) {
 	plugin := Plugin{Diff: "echo ./bar-service"}
-	cmd, args, err := uploadPipeline(plugin, generatePipeline)
+	uploader := &recordingUploader{}
+	err := uploadPipeline(plugin, generatePipeline, uploader)
 
-	assert.Equal(t, "", cmd)
-	assert.Equal(t, []string{}, args)
+	assert.Empty(t, uploader.pipelines)
 	assert.Equal(t, nil, err)
 }
 
@@ -247,6 +241,14 @@ func TestDiffQuotedPathsWithSpaces(t *testing.T) {
 	assert.Equal(t, want, got)
 }
 
+func TestDiffBaseRef(t *testing.T) {
+	assert.Equal(t, "HEAD~1", diffBaseRef("git diff --name-only HEAD~1"))
+	assert.Equal(t, "origin/main...HEAD", diffBaseRef("git diff --name-only origin/main...HEAD"))
+	assert.Equal(t, "", diffBaseRef("git diff --name-only $(git merge-base HEAD origin/main)"))
+	assert.Equal(t, "", diffBaseRef("git diff --name-only -- services/"))
+	assert.Equal(t, "", diffBaseRef("./diff.sh"))
+}
+
 func TestStepsToTriggerWithEmojiPaths(t *testing.T) {
 	watch := []WatchConfig{
 		{
@@ -260,7 +262,7 @@ func TestStepsToTriggerWithEmojiPaths(t *testing.T) {
 		"other/file.txt",
 	}
 
-	steps, err := stepsToTrigger(changedFiles, watch)
+	steps, err := stepsToTrigger(changedFiles, Plugin{Watch: watch})
 	assert.NoError(t, err)
 	assert.Equal(t, []Step{{Trigger: "test-pipeline"}}, steps)
 }
@@ -294,7 +296,7 @@ func TestPipelinesToTriggerGetsListOfPipelines(t *testing.T) {
 		"watch-path-4/test/index_test.go",
 	}
 
-	pipelines, err := stepsToTrigger(changedFiles, watch)
+	pipelines, err := stepsToTrigger(changedFiles, Plugin{Watch: watch})
 	assert.NoError(t, err)
 	var got []string
 
@@ -552,7 +554,7 @@ func TestPipelinesStepsToTrigger(t *testing.T) {
 
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
-			steps, err := stepsToTrigger(tc.ChangedFiles, tc.WatchConfigs)
+			steps, err := stepsToTrigger(tc.ChangedFiles, Plugin{Watch: tc.WatchConfigs})
 			assert.NoError(t, err)
 			assert.Equal(t, tc.Expected, steps)
 		})
@@ -722,7 +724,7 @@ func TestRegexPaths(t *testing.T) {
 
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
-			steps, err := stepsToTrigger(tc.ChangedFiles, tc.WatchConfigs)
+			steps, err := stepsToTrigger(tc.ChangedFiles, Plugin{Watch: tc.WatchConfigs})
 			if tc.ExpectError {
 				assert.Error(t, err)
 			} else {
@@ -1550,7 +1552,7 @@ func TestStepsToTrigger_Issue83(t *testing.T) {
 		"other-path/file.txt",
 	}
 
-	steps, err := stepsToTrigger(changedFiles, watch)
+	steps, err := stepsToTrigger(changedFiles, Plugin{Watch: watch})
 
 	assert.NoError(t, err)
 	assert.Len(t, steps, 1)
@@ -1572,7 +1574,7 @@ func TestStepsToTrigger_DefaultWithEmptyStep(t *testing.T) {
 
 	changedFiles := []string{"unmatched/file.txt"}
 
-	steps, err := stepsToTrigger(changedFiles, watch)
+	steps, err := stepsToTrigger(changedFiles, Plugin{Watch: watch})
 
 	assert.NoError(t, err)
 	assert.Len(t, steps, 0)
@@ -1593,7 +1595,7 @@ func TestStepsToTrigger_AllStepsInvalid(t *testing.T) {
 
 	changedFiles := []string{"path1/file.txt", "path2/file.txt"}
 
-	steps, err := stepsToTrigger(changedFiles, watch)
+	steps, err := stepsToTrigger(changedFiles, Plugin{Watch: watch})
 
 	assert.NoError(t, err)
 	assert.Len(t, steps, 0)
@@ -1613,7 +1615,7 @@ func TestStepsToTrigger_EmptyGroupInConfig(t *testing.T) {
 
 	changedFiles := []string{"services/main.go"}
 
-	steps, err := stepsToTrigger(changedFiles, watch)
+	steps, err := stepsToTrigger(changedFiles, Plugin{Watch: watch})
 
 	assert.NoError(t, err)
 	assert.Len(t, steps, 0)
@@ -1642,7 +1644,7 @@ func TestStepsToTrigger_ValidAndInvalidStepsMixed(t *testing.T) {
 		"deploy/script.sh",
 	}
 
-	steps, err := stepsToTrigger(changedFiles, watch)
+	steps, err := stepsToTrigger(changedFiles, Plugin{Watch: watch})
 
 	assert.NoError(t, err)
 	assert.Len(t, steps, 2)
@@ -1712,3 +1714,270 @@ func TestGeneratePipelineWithRetry(t *testing.T) {
 
 	validatePipelineWithAgent(t, pipeline.Name())
 }
+
+func TestGeneratePipelineWithBlockAndInputSteps(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{
+				"path": "services/api/",
+				"config": [
+					{
+						"input": "Release details",
+						"key": "release-details",
+						"fields": [{ "text": "Release notes", "key": "release-notes", "required": false }]
+					},
+					{
+						"block": ":rocket: Deploy API to production?",
+						"key": "approve-api",
+						"prompt": "This deploys every service change",
+						"blocked_state": "running",
+						"depends_on": "release-details"
+					},
+					{
+						"trigger": "api-deploy",
+						"depends_on": "approve-api",
+						"build": { "message": "Deploy API" }
+					}
+				]
+			}]
+		}
+	}]`
+
+	plugin, err := initializePlugin(param)
+	require.NoError(t, err)
+
+	steps, err := stepsToTrigger([]string{"services/api/main.go"}, plugin)
+	require.NoError(t, err)
+	require.Len(t, steps, 3)
+
+	pipeline, _, err := generatePipeline(steps, Plugin{})
+	require.NoError(t, err)
+	defer func() {
+		if err = os.Remove(pipeline.Name()); err != nil {
+			t.Logf("Failed to remove temporary pipeline file: %v", err)
+		}
+	}()
+
+	got, err := os.ReadFile(pipeline.Name())
+	require.NoError(t, err)
+
+	want := `steps:
+    - input: Release details
+      fields:
+        - key: release-notes
+          required: false
+          text: Release notes
+      key: release-details
+    - block: ':rocket: Deploy API to production?'
+      prompt: This deploys every service change
+      blocked_state: running
+      depends_on: release-details
+      key: approve-api
+    - trigger: api-deploy
+      build:
+        message: Deploy API
+        branch: go-rewrite
+        commit: "123"
+      depends_on: approve-api
+`
+
+	t.Log("Generated pipeline:\n" + string(got))
+	assert.Equal(t, want, string(got))
+
+	validatePipelineWithAgent(t, pipeline.Name())
+}
+
+func TestGeneratePipelineWithWaitConfig(t *testing.T) {
+	steps := []Step{{Command: "echo hello"}}
+
+	plugin := Plugin{
+		Wait: true,
+		WaitConfig: WaitStep{
+			ContinueOnFailure:      true,
+			Condition:              "build.branch == 'main'",
+			DependsOn:              "tests",
+			AllowDependencyFailure: true,
+		},
+	}
+
+	pipeline, _, err := generatePipeline(steps, plugin)
+	require.NoError(t, err)
+	defer func() {
+		if err = os.Remove(pipeline.Name()); err != nil {
+			t.Logf("Failed to remove temporary pipeline file: %v", err)
+		}
+	}()
+
+	got, err := os.ReadFile(pipeline.Name())
+	require.NoError(t, err)
+
+	want := `steps:
+    - command: echo hello
+    - wait: null
+      continue_on_failure: true
+      if: build.branch == 'main'
+      depends_on: tests
+      allow_dependency_failure: true
+`
+
+	assert.Equal(t, want, string(got))
+}
+
+func TestGeneratePipelineWithWaitStepsInConfig(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{
+				"path": "services/api/",
+				"config": [
+					{ "command": "make test", "label": "Test API" },
+					"wait",
+					{ "trigger": "api-deploy" },
+					{ "wait": { "continue_on_failure": true } },
+					{ "command": "make cleanup" },
+					{ "wait": null, "if": "build.branch == 'main'" },
+					{ "command": "make notify" }
+				]
+			}]
+		}
+	}]`
+
+	plugin, err := initializePlugin(param)
+	require.NoError(t, err)
+
+	steps, err := stepsToTrigger([]string{"services/api/main.go"}, plugin)
+	require.NoError(t, err)
+	require.Len(t, steps, 7)
+
+	pipeline, _, err := generatePipeline(steps, Plugin{})
+	require.NoError(t, err)
+	defer func() {
+		if err = os.Remove(pipeline.Name()); err != nil {
+			t.Logf("Failed to remove temporary pipeline file: %v", err)
+		}
+	}()
+
+	got, err := os.ReadFile(pipeline.Name())
+	require.NoError(t, err)
+
+	want := `steps:
+    - label: Test API
+      command: make test
+    - wait: null
+    - trigger: api-deploy
+      build:
+        message: 'fix: temp file not correctly deleted'
+        branch: go-rewrite
+        commit: "123"
+    - wait: null
+      continue_on_failure: true
+    - command: make cleanup
+    - wait: null
+      if: build.branch == 'main'
+    - command: make notify
+`
+
+	assert.Equal(t, want, string(got))
+}
+
+func TestStepsToTriggerWithAlwaysAndUncovered(t *testing.T) {
+	plugin := Plugin{
+		Watch: []WatchConfig{
+			{Name: "api", Paths: []string{"services/api/"}, Steps: []Step{{Command: "make api"}}},
+			{Name: "docs", Paths: []string{"docs/"}, SkipPaths: []string{"docs/drafts/"}, Steps: []Step{{Command: "make docs"}}},
+			{Name: "always", Always: true, Steps: []Step{{Command: "make lint"}}},
+			{Name: "uncovered", Uncovered: true, Steps: []Step{{Command: "./check-ownership.sh"}, {Trigger: "full-build"}}},
+			{Name: "default", Default: true, Steps: []Step{{Command: "echo nothing matched"}}},
+		},
+	}
+
+	steps, err := stepsToTrigger([]string{"services/api/main.go", "docs/drafts/idea.md", "services/new/main.go"}, plugin)
+	require.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Command: "make api"},
+		{Command: "make lint"},
+		{Command: "./check-ownership.sh", Env: map[string]string{matchedFilesEnv: "docs/drafts/idea.md\nservices/new/main.go"}, MatchedFiles: true},
+		{Trigger: "full-build", Build: Build{Env: map[string]string{matchedFilesEnv: "docs/drafts/idea.md\nservices/new/main.go"}}, MatchedFiles: true},
+	}, steps)
+
+	// every file is covered, so only the always steps are added
+	steps, err = stepsToTrigger([]string{"services/api/main.go", "docs/index.md"}, plugin)
+	require.NoError(t, err)
+	assert.Equal(t, []Step{{Command: "make api"}, {Command: "make docs"}, {Command: "make lint"}}, steps)
+
+	// with no watch matching, default runs alongside always and uncovered
+	steps, err = stepsToTrigger([]string{"README.md"}, plugin)
+	require.NoError(t, err)
+	require.Len(t, steps, 4)
+	assert.Equal(t, Step{Command: "make lint"}, steps[0])
+	assert.Equal(t, "README.md", steps[1].Env[matchedFilesEnv])
+	assert.Equal(t, Step{Command: "echo nothing matched"}, steps[3])
+}
+
+func TestStepsToTriggerFailOnUncovered(t *testing.T) {
+	plugin := Plugin{
+		FailOnUncovered: true,
+		IgnoreUncovered: []string{"*.md", ".github/"},
+		Watch: []WatchConfig{
+			{Name: "api", Paths: []string{"services/api/"}, ExceptPaths: []string{"services/api/VERSION"}, Steps: []Step{{Command: "make api"}}},
+			{Name: "docs", Paths: []string{"docs/"}, SkipPaths: []string{"docs/drafts/"}, Steps: []Step{{Command: "make docs"}}},
+		},
+	}
+
+	// excepted watches still cover their files, ignored files need no watch
+	steps, err := stepsToTrigger([]string{"services/api/main.go", "services/api/VERSION", "README.md", ".github/CODEOWNERS"}, plugin)
+	require.NoError(t, err)
+	assert.Equal(t, []Step{}, steps)
+
+	_, err = stepsToTrigger([]string{"services/api/main.go", "docs/drafts/idea.md", "services/new/main.go", "docs/index.md"}, plugin)
+	assert.EqualError(t, err, "2 changed files are not covered by any watch:\ndocs/drafts/idea.md\nservices/new/main.go")
+}
+
+func TestStepsToTriggerOnEmptyDiff(t *testing.T) {
+	watch := []WatchConfig{
+		{Name: "api", Paths: []string{"services/api/"}, Steps: []Step{{Command: "make api"}}},
+		{Name: "dirs", Paths: []string{"services/"}, ForEach: forEachMatchedDir, Depth: 2, Steps: []Step{{Command: "make -C {{.Dir}}"}}},
+		{Name: "always", Always: true, Steps: []Step{{Command: "make lint"}}},
+		{Name: "default", Default: true, Steps: []Step{{Command: "echo default"}}},
+	}
+
+	steps, err := stepsToTrigger([]string{}, Plugin{OnEmptyDiff: onEmptyDiffDefault, Watch: watch})
+	require.NoError(t, err)
+	assert.Equal(t, []Step{{Command: "make lint"}, {Command: "echo default"}}, steps)
+
+	// fan-out watches have no matched directories to generate steps for
+	steps, err = stepsToTrigger([]string{}, Plugin{OnEmptyDiff: onEmptyDiffAll, Watch: watch})
+	require.NoError(t, err)
+	assert.Equal(t, []Step{{Command: "make api"}, {Command: "make lint"}}, steps)
+
+	matrix := WatchConfig{Name: "matrix", Paths: []string{"services/"}, Steps: []Step{{Command: "make", Matrix: map[string]interface{}{"from_matched": "dir"}}}}
+	result, err := summarize([]string{}, Plugin{OnEmptyDiff: onEmptyDiffAll, Watch: []WatchConfig{watch[1], matrix}})
+	require.NoError(t, err)
+	assert.Equal(t, []watchResult{
+		{Name: "dirs", Reason: "no matched files to expand for an empty diff"},
+		{Name: "matrix", Reason: "no matched files to expand for an empty diff"},
+	}, result.Watches)
+}
+
+func TestUploadPipelineOnEmptyDiff(t *testing.T) {
+	plugin := Plugin{
+		Diff:        "echo",
+		OnEmptyDiff: onEmptyDiffDefault,
+		Watch:       []WatchConfig{{Name: "default", Default: true, Steps: []Step{{Command: "echo default"}}}},
+	}
+
+	agent, err := bintest.NewMock("buildkite-agent")
+	require.NoError(t, err)
+
+	oldPath := os.Getenv("PATH")
+	t.Cleanup(func() { _ = os.Setenv("PATH", oldPath) })
+	_ = os.Setenv("PATH", filepath.Dir(agent.Path)+":"+oldPath)
+
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--no-interpolation").
+		AndExitWith(0)
+
+	err = uploadPipeline(plugin, mockGeneratePipeline, agentUploader{interpolation: plugin.Interpolation})
+	assert.NoError(t, err)
+
+	require.NoError(t, agent.CheckAndClose(t))
+}
@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/url"
 	"path"
+	"reflect"
+	"slices"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -15,46 +18,86 @@ const pluginName = "monorepo-diff"
 
 // Plugin buildkite monorepo diff plugin structure
 type Plugin struct {
-	Diff          string
-	Wait          bool
-	LogLevel      string `json:"log_level"`
-	Interpolation bool
-	Hooks         []HookConfig
-	Watch         []WatchConfig
-	RawEnv        interface{} `json:"env"`
-	Env           map[string]string
-	Metadata      map[string]string        `json:"meta_data"`
-	RawNotify     []map[string]interface{} `json:"notify" yaml:",omitempty"`
-	Notify        []PluginNotify           `yaml:"notify,omitempty"`
+	Diff               string                   `json:"diff"`
+	Wait               bool                     `json:"-"`
+	RawWait            interface{}              `json:"wait"`
+	WaitConfig         WaitStep                 `json:"-"`
+	LogLevel           string                   `json:"log_level"`
+	LogFormat          string                   `json:"log_format"`
+	Interpolation      bool                     `json:"interpolation"`
+	Templates          bool                     `json:"templates"`
+	PassMatchedFiles   bool                     `json:"pass_matched_files"`
+	TriggerContext     bool                     `json:"trigger_context"`
+	DuplicateSteps     string                   `json:"duplicate_steps"`
+	GroupBy            string                   `json:"group_by"`
+	FailOnUncovered    bool                     `json:"fail_on_uncovered"`
+	FailOnNoMatch      bool                     `json:"fail_on_no_match"`
+	OnEmptyDiff        string                   `json:"on_empty_diff"`
+	RawIgnoreUncovered interface{}              `json:"ignore_uncovered"`
+	IgnoreUncovered    []string                 `json:"-"`
+	DiffBase           string                   `json:"diff_base"`
+	Output             string                   `json:"output"`
+	OutputPath         string                   `json:"output_path"`
+	Replace            bool                     `json:"replace"`
+	RejectSecrets      bool                     `json:"reject_secrets"`
+	JWKSFile           string                   `json:"jwks_file"`
+	JWKSKeyID          string                   `json:"jwks_key_id"`
+	RawUploadArgs      interface{}              `json:"upload_args"`
+	UploadArgs         []string                 `json:"-"`
+	UploadRetries      int                      `json:"upload_retries"`
+	UploadMaxSteps     int                      `json:"upload_max_steps"`
+	UploadMaxSize      int                      `json:"upload_max_size"`
+	RawAnnotate        interface{}              `json:"annotate"`
+	Annotate           *Annotation              `json:"-"`
+	RawRecordMetadata  interface{}              `json:"record_meta_data"`
+	RecordMetadata     *ResultMetadata          `json:"-"`
+	Hooks              []HookConfig             `json:"hooks"`
+	Watch              []WatchConfig            `json:"watch"`
+	RawEnv             interface{}              `json:"env"`
+	Env                map[string]string        `json:"-"`
+	Metadata           map[string]string        `json:"meta_data"`
+	RawNotify          []map[string]interface{} `json:"notify" yaml:",omitempty"`
+	Notify             []PluginNotify           `json:"-" yaml:"notify,omitempty"`
 }
 
 // HookConfig Plugin hook configuration
 type HookConfig struct {
-	Command string
+	Command string `json:"command"`
 }
 
 // WatchConfig Plugin watch configuration
 type WatchConfig struct {
+	Name          string      `json:"name"`
 	RawPath       interface{} `json:"path"`
-	Paths         []string
+	Paths         []string    `json:"-"`
 	RawConfig     interface{} `json:"config"`
-	Steps         []Step
+	Steps         []Step      `json:"-"`
 	Default       interface{} `json:"default"`
 	RawSkipPath   interface{} `json:"skip_path"`
 	RawExceptPath interface{} `json:"except_path"`
-	SkipPaths     []string
-	ExceptPaths   []string
-	RegexPaths    bool `json:"regex_paths"`
+	SkipPaths     []string    `json:"-"`
+	ExceptPaths   []string    `json:"-"`
+	RegexPaths    bool        `json:"regex_paths"`
+	ForEach       string      `json:"for_each"`
+	Depth         int         `json:"depth"`
+	Always        interface{} `json:"always"`
+	Uncovered     interface{} `json:"uncovered"`
+	RawAfter      interface{} `json:"after"`
+	After         []string    `json:"-"`
+	Key           string      `json:"key"`
+	DependsOn     interface{} `json:"depends_on"`
+	Condition     string      `json:"if"`
 }
 
 type Group struct {
-	Label                  string       `yaml:"group"`
-	Key                    string       `yaml:"key,omitempty"`
-	Steps                  []Step       `yaml:"steps"`
-	DependsOn              interface{}  `yaml:"depends_on,omitempty"`
-	Condition              string       `yaml:"if,omitempty"`
-	Notify                 []StepNotify `yaml:"notify,omitempty"`
-	AllowDependencyFailure bool         `yaml:"allow_dependency_failure,omitempty"`
+	Label                  string                 `yaml:"group"`
+	Key                    string                 `yaml:"key,omitempty"`
+	Steps                  []Step                 `yaml:"steps"`
+	DependsOn              interface{}            `yaml:"depends_on,omitempty"`
+	Condition              string                 `yaml:"if,omitempty"`
+	Notify                 []StepNotify           `yaml:"notify,omitempty"`
+	AllowDependencyFailure bool                   `yaml:"allow_dependency_failure,omitempty"`
+	Extra                  map[string]interface{} `yaml:",inline"`
 }
 
 // GithubStatusNotification is notification config for github_commit_status
@@ -83,43 +126,62 @@ type StepNotify struct {
 
 // Step is buildkite pipeline definition
 type Step struct {
-	Group                  string                   `yaml:"group,omitempty"`
-	Trigger                string                   `yaml:"trigger,omitempty"`
-	Label                  string                   `yaml:"label,omitempty"`
-	Branches               string                   `yaml:"branches,omitempty"`
+	Group                  string                   `json:"group" yaml:"group,omitempty"`
+	Trigger                string                   `json:"trigger" yaml:"trigger,omitempty"`
+	Block                  string                   `json:"block" yaml:"block,omitempty"`
+	Input                  string                   `json:"input" yaml:"input,omitempty"`
+	Prompt                 string                   `json:"prompt" yaml:"prompt,omitempty"`
+	Fields                 interface{}              `json:"fields" yaml:"fields,omitempty"`
+	BlockedState           string                   `json:"blocked_state" yaml:"blocked_state,omitempty"`
+	Label                  string                   `json:"label" yaml:"label,omitempty"`
+	Branches               interface{}              `json:"branches" yaml:"branches,omitempty"`
 	Condition              string                   `json:"if,omitempty" yaml:"if,omitempty"`
-	Build                  Build                    `yaml:"build,omitempty"`
-	Command                interface{}              `yaml:"command,omitempty"`
-	Commands               interface{}              `yaml:"commands,omitempty"`
-	Agents                 Agent                    `yaml:"agents,omitempty"`
+	Build                  Build                    `json:"build" yaml:"build,omitempty"`
+	Command                interface{}              `json:"command" yaml:"command,omitempty"`
+	Commands               interface{}              `json:"commands" yaml:"commands,omitempty"`
+	Agents                 Agent                    `json:"agents" yaml:"agents,omitempty"`
 	ArtifactPaths          []string                 `json:"artifact_paths" yaml:"artifact_paths,omitempty"`
 	RawEnv                 interface{}              `json:"env" yaml:",omitempty"`
 	Plugins                []map[string]interface{} `json:"plugins,omitempty" yaml:"plugins,omitempty"`
-	Env                    map[string]string        `yaml:"env,omitempty"`
-	Async                  bool                     `yaml:"async,omitempty"`
+	Env                    map[string]string        `json:"-" yaml:"env,omitempty"`
+	Async                  bool                     `json:"async" yaml:"async,omitempty"`
 	SoftFail               interface{}              `json:"soft_fail" yaml:"soft_fail,omitempty"`
 	Retry                  interface{}              `json:"retry,omitempty" yaml:"retry,omitempty"`
 	RawNotify              []map[string]interface{} `json:"notify" yaml:",omitempty"`
-	Notify                 []StepNotify             `yaml:"notify,omitempty"`
+	Notify                 []StepNotify             `json:"-" yaml:"notify,omitempty"`
 	DependsOn              interface{}              `json:"depends_on" yaml:"depends_on,omitempty"`
-	Key                    string                   `yaml:"key,omitempty"`
+	Key                    string                   `json:"key" yaml:"key,omitempty"`
 	Secrets                interface{}              `json:"secrets,omitempty" yaml:"secrets,omitempty"`
-	Steps                  []Step                   `yaml:"steps,omitempty"`
+	Steps                  []Step                   `json:"steps" yaml:"steps,omitempty"`
 	AllowDependencyFailure bool                     `json:"allow_dependency_failure,omitempty" yaml:"allow_dependency_failure,omitempty"`
-	Matrix                 interface{}              `yaml:"matrix,omitempty"`
+	Matrix                 interface{}              `json:"matrix" yaml:"matrix,omitempty"`
+	// EnvFromOS are the keys of Env read from the agent's environment,
+	// which are passed through without rendering templates
+	EnvFromOS map[string]bool `json:"-" yaml:"-"`
+	// MatchedFiles is set when the plugin passed the matched files in the
+	// env of this step, or the build env of a trigger
+	MatchedFiles bool `json:"-" yaml:"-"`
+	// Wait makes this a wait step, with the common attributes above
+	Wait *WaitStep `json:"-" yaml:"-"`
+	// Extra holds the attributes Step doesn't model, passed through as is
+	Extra map[string]interface{} `json:"-" yaml:",inline"`
 }
 
-// isValid checks if a step has required fields (command, trigger, or group with steps)
+// isValid checks if a step has required fields (command, trigger, block, input, or group with steps),
+// or is a wait step
 func (s Step) isValid() bool {
+	if s.Wait != nil {
+		return true
+	}
 	if s.Group != "" {
 		return s.hasValidNesting()
 	}
 	return s.hasAction()
 }
 
-// hasAction checks if a step has a command or trigger
+// hasAction checks if a step has a command, trigger, block or input
 func (s Step) hasAction() bool {
-	return s.Command != nil || s.Commands != nil || s.Trigger != ""
+	return s.Command != nil || s.Commands != nil || s.Trigger != "" || s.Block != "" || s.Input != ""
 }
 
 // hasValidNesting validates group step nesting
@@ -143,6 +205,16 @@ func (s Step) hasValidNesting() bool {
 // UnmarshalJSON handles both "artifacts" and "artifact_paths" field names for backward compatibility
 // Both fields are supported by the Buildkite API; "artifact_paths" is preferred per documentation
 func (step *Step) UnmarshalJSON(data []byte) error {
+	// Steps can be given as the string "wait", like in a Buildkite pipeline
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		if name != "wait" {
+			return fmt.Errorf("unsupported step %q", name)
+		}
+		*step = Step{Wait: &WaitStep{}}
+		return nil
+	}
+
 	// Check which fields are present without full unmarshaling
 	var fieldCheck map[string]json.RawMessage
 	if err := json.Unmarshal(data, &fieldCheck); err != nil {
@@ -176,21 +248,164 @@ func (step *Step) UnmarshalJSON(data []byte) error {
 		step.ArtifactPaths = temp.Artifacts
 	}
 
+	if rawWait, isWait := fieldCheck["wait"]; isWait {
+		if err := step.setWait(rawWait, fieldCheck); err != nil {
+			return err
+		}
+		delete(fieldCheck, "continue_on_failure")
+	}
+
+	extra, err := extraFields(fieldCheck, stepFields)
+	step.Extra = extra
+
+	return err
+}
+
+// UnmarshalJSON keeps the build attributes Build doesn't model in Extra
+func (build *Build) UnmarshalJSON(data []byte) error {
+	type buildAlias Build
+	if err := json.Unmarshal(data, (*buildAlias)(build)); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	extra, err := extraFields(fields, buildFields)
+	build.Extra = extra
+
+	return err
+}
+
+// extraFields returns the values of fields whose keys aren't in known, or
+// nil when there are none
+func extraFields(fields map[string]json.RawMessage, known map[string]bool) (map[string]interface{}, error) {
+	var extra map[string]interface{}
+	for key := range fields {
+		if known[strings.ToLower(key)] {
+			continue
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(fields[key], &value); err != nil {
+			return nil, err
+		}
+
+		if extra == nil {
+			extra = make(map[string]interface{})
+		}
+		extra[key] = integralNumbers(value)
+	}
+
+	return extra, nil
+}
+
+// setWait makes step a wait step. Its attributes can be given in the wait
+// object or alongside it, as Buildkite allows both.
+func (step *Step) setWait(rawWait json.RawMessage, fields map[string]json.RawMessage) error {
+	var wait WaitStep
+	if err := json.Unmarshal(rawWait, &wait); err != nil {
+		if string(rawWait) != "null" && string(rawWait) != `""` {
+			return fmt.Errorf("failed to parse wait step: %v", err)
+		}
+	}
+
+	if raw, ok := fields["continue_on_failure"]; ok {
+		if err := json.Unmarshal(raw, &wait.ContinueOnFailure); err != nil {
+			return fmt.Errorf("failed to parse wait step: %v", err)
+		}
+	}
+
+	if step.Key == "" {
+		step.Key = wait.Key
+	}
+	if step.Condition == "" {
+		step.Condition = wait.Condition
+	}
+	if step.DependsOn == nil {
+		step.DependsOn = wait.DependsOn
+	}
+	if step.Branches == nil {
+		step.Branches = wait.Branches
+	}
+	step.AllowDependencyFailure = step.AllowDependencyFailure || wait.AllowDependencyFailure
+
+	step.Wait = &WaitStep{ContinueOnFailure: wait.ContinueOnFailure}
+
 	return nil
 }
 
+// stepFields are the lower-cased JSON keys of the attributes Step models,
+// matched case-insensitively like encoding/json does
+var stepFields = func() map[string]bool {
+	fields := jsonFields(reflect.TypeOf(Step{}))
+	fields["artifacts"] = true
+	fields["wait"] = true
+
+	return fields
+}()
+
+// buildFields are the lower-cased JSON keys of the attributes Build models
+var buildFields = jsonFields(reflect.TypeOf(Build{}))
+
+// jsonFields returns the lower-cased JSON keys of the fields of struct type
+// t, those with a json tag naming them. Fields without one hold parsed
+// values rather than configuration.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[strings.ToLower(name)] = true
+	}
+
+	return fields
+}
+
+// integralNumbers converts whole numbers decoded from JSON as float64 back to
+// integers, so they are written to YAML as they were configured
+func integralNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = integralNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = integralNumbers(v[k])
+		}
+	}
+
+	return value
+}
+
 // Agent is Buildkite agent definition
-type Agent map[string]string
+type Agent map[string]interface{}
 
 // Build is buildkite build definition
 type Build struct {
-	Message  string            `yaml:"message,omitempty"`
-	Branch   string            `yaml:"branch,omitempty"`
-	Commit   string            `yaml:"commit,omitempty"`
+	Message  string            `json:"message" yaml:"message,omitempty"`
+	Branch   string            `json:"branch" yaml:"branch,omitempty"`
+	Commit   string            `json:"commit" yaml:"commit,omitempty"`
 	RawEnv   interface{}       `json:"env" yaml:",omitempty"`
-	Env      map[string]string `yaml:"env,omitempty"`
+	Env      map[string]string `json:"-" yaml:"env,omitempty"`
 	Metadata map[string]string `json:"meta_data" yaml:"meta_data,omitempty"`
+	// EnvFromOS are the keys of Env read from the agent's environment
+	EnvFromOS map[string]bool `json:"-" yaml:"-"`
 	// Notify  []Notify          `yaml:"notify,omitempty"`
+	// DefaultMessage is true when Message is the commit message set by
+	// setBuild, rather than one from the config
+	DefaultMessage bool `json:"-" yaml:"-"`
+	// Extra holds the attributes Build doesn't model, passed through as is
+	Extra map[string]interface{} `json:"-" yaml:",inline"`
 }
 
 // UnmarshalJSON set defaults properties
@@ -216,6 +431,7 @@ func (plugin *Plugin) UnmarshalJSON(data []byte) error {
 	}
 
 	plugin.Env = parseResult
+	osEnv := envFromOS(plugin.RawEnv)
 	plugin.RawEnv = nil
 
 	metaDataParseResult, err := parseMetadata(plugin.Metadata)
@@ -227,66 +443,166 @@ func (plugin *Plugin) UnmarshalJSON(data []byte) error {
 
 	setPluginNotify(&plugin.Notify, &plugin.RawNotify)
 
+	// wait can be a boolean, or the attributes of the wait step to add
+	switch wait := plugin.RawWait.(type) {
+	case bool:
+		plugin.Wait = wait
+	case map[string]interface{}:
+		b, err := json.Marshal(wait)
+		if err != nil {
+			return fmt.Errorf("failed to parse wait configuration: %v", err)
+		}
+		if err := json.Unmarshal(b, &plugin.WaitConfig); err != nil {
+			return fmt.Errorf("failed to parse wait configuration: %v", err)
+		}
+		plugin.Wait = true
+	}
+	plugin.RawWait = nil
+
+	switch plugin.LogFormat {
+	case "", logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("unsupported log_format value %q, expected %q or %q", plugin.LogFormat, logFormatText, logFormatJSON)
+	}
+
+	switch plugin.OnEmptyDiff {
+	case "", onEmptyDiffSkip, onEmptyDiffDefault, onEmptyDiffAll:
+	default:
+		return fmt.Errorf("unsupported on_empty_diff value %q, expected %q, %q or %q", plugin.OnEmptyDiff, onEmptyDiffSkip, onEmptyDiffDefault, onEmptyDiffAll)
+	}
+
+	// annotate can be a boolean, or the style and context of the annotation
+	switch annotate := plugin.RawAnnotate.(type) {
+	case bool:
+		if annotate {
+			plugin.Annotate = &Annotation{Style: defaultAnnotationStyle, Context: defaultAnnotationContext}
+		}
+	case map[string]interface{}:
+		b, err := json.Marshal(annotate)
+		if err != nil {
+			return fmt.Errorf("failed to parse annotate configuration: %v", err)
+		}
+		plugin.Annotate = &Annotation{Style: defaultAnnotationStyle, Context: defaultAnnotationContext}
+		if err := json.Unmarshal(b, plugin.Annotate); err != nil {
+			return fmt.Errorf("failed to parse annotate configuration: %v", err)
+		}
+		if !slices.Contains(annotationStyles, plugin.Annotate.Style) {
+			return fmt.Errorf("unsupported annotate style %q, expected %q, %q, %q or %q", plugin.Annotate.Style, annotationStyles[0], annotationStyles[1], annotationStyles[2], annotationStyles[3])
+		}
+	}
+	plugin.RawAnnotate = nil
+
+	// record_meta_data can be a boolean, or the prefix and keys to record
+	// the results under
+	switch record := plugin.RawRecordMetadata.(type) {
+	case bool:
+		if record {
+			plugin.RecordMetadata = &ResultMetadata{Prefix: metadataPrefix}
+		}
+	case map[string]interface{}:
+		b, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to parse record_meta_data configuration: %v", err)
+		}
+		plugin.RecordMetadata = &ResultMetadata{Prefix: metadataPrefix}
+		if err := json.Unmarshal(b, plugin.RecordMetadata); err != nil {
+			return fmt.Errorf("failed to parse record_meta_data configuration: %v", err)
+		}
+		if err := plugin.RecordMetadata.validate(); err != nil {
+			return err
+		}
+	}
+	plugin.RawRecordMetadata = nil
+
+	if plugin.UploadArgs, err = stringList("upload_args", plugin.RawUploadArgs); err != nil {
+		return err
+	}
+	plugin.RawUploadArgs = nil
+
+	if plugin.UploadRetries < 0 {
+		return fmt.Errorf("upload_retries must be a positive number, got %d", plugin.UploadRetries)
+	}
+	if plugin.UploadMaxSteps < 0 {
+		return fmt.Errorf("upload_max_steps must be a positive number, got %d", plugin.UploadMaxSteps)
+	}
+	if plugin.UploadMaxSize < 0 {
+		return fmt.Errorf("upload_max_size must be a positive number, got %d", plugin.UploadMaxSize)
+	}
+
+	switch plugin.Output {
+	case "", outputAgent, outputStdout, outputJSON:
+	case outputFile:
+		if plugin.OutputPath == "" {
+			return fmt.Errorf("output %q requires output_path", outputFile)
+		}
+	default:
+		return fmt.Errorf("unsupported output value %q, expected %q, %q, %q or %q", plugin.Output, outputAgent, outputStdout, outputFile, outputJSON)
+	}
+
+	switch plugin.DuplicateSteps {
+	case "", duplicateFirstWins, duplicateMerge, duplicateError:
+	default:
+		return fmt.Errorf("unsupported duplicate_steps value %q, expected %q, %q or %q", plugin.DuplicateSteps, duplicateFirstWins, duplicateMerge, duplicateError)
+	}
+
+	if plugin.IgnoreUncovered, err = stringList("ignore_uncovered", plugin.RawIgnoreUncovered); err != nil {
+		return err
+	}
+	plugin.RawIgnoreUncovered = nil
+
 	for i, p := range plugin.Watch {
-		if p.Default != nil {
+		if !p.hasPaths() {
 			plugin.Watch[i].Paths = []string{}
-			if config, ok := p.Default.(map[string]interface{}); ok && len(config) > 0 {
-				var conf interface{} = config
-				if nested, ok := config["config"]; ok {
-					conf = nested
+			configs := []*interface{}{&plugin.Watch[i].Default, &plugin.Watch[i].Always, &plugin.Watch[i].Uncovered}
+			parsed := 0
+			for _, raw := range configs {
+				if *raw == nil {
+					continue
+				}
+				parsed++
+				if parsed > 1 {
+					return errors.New("a watch can only have one of default, always and uncovered")
 				}
-				b, err := json.Marshal(conf)
+
+				steps, err := parseShorthandConfig(*raw)
 				if err != nil {
 					return err
 				}
-
-				switch conf.(type) {
-				case []interface{}:
-					var steps []Step
-					if err := json.Unmarshal(b, &steps); err != nil {
-						return err
-					}
+				if steps != nil {
 					plugin.Watch[i].Steps = steps
-				default:
-					var step Step
-					if err := json.Unmarshal(b, &step); err != nil {
-						return err
-					}
-					plugin.Watch[i].Steps = []Step{step}
 				}
+				*raw = true
 			}
-			plugin.Watch[i].Default = true
 		} else if p.RawPath != nil {
 			// Path, SkipPath and ExceptPath can be string or an array of strings,
 			// handle both cases and create an array of paths on all.
-			switch p.RawPath.(type) {
-			case string:
-				plugin.Watch[i].Paths = []string{plugin.Watch[i].RawPath.(string)}
-			case []interface{}:
-				for _, v := range plugin.Watch[i].RawPath.([]interface{}) {
-					plugin.Watch[i].Paths = append(plugin.Watch[i].Paths, v.(string))
-				}
+			paths, err := stringList("path", p.RawPath)
+			if err != nil {
+				return err
 			}
+			plugin.Watch[i].Paths = paths
 		}
 
-		switch p.RawSkipPath.(type) {
-		case string:
-			plugin.Watch[i].SkipPaths = []string{plugin.Watch[i].RawSkipPath.(string)}
-		case []interface{}:
-			for _, v := range plugin.Watch[i].RawSkipPath.([]interface{}) {
-				plugin.Watch[i].SkipPaths = append(plugin.Watch[i].SkipPaths, v.(string))
-			}
+		if p.ForEach != "" && p.ForEach != forEachMatchedDir {
+			return fmt.Errorf("unsupported for_each value %q, expected %q", p.ForEach, forEachMatchedDir)
 		}
 
-		switch p.RawExceptPath.(type) {
-		case string:
-			plugin.Watch[i].ExceptPaths = []string{plugin.Watch[i].RawExceptPath.(string)}
-		case []interface{}:
-			for _, v := range plugin.Watch[i].RawExceptPath.([]interface{}) {
-				plugin.Watch[i].ExceptPaths = append(plugin.Watch[i].ExceptPaths, v.(string))
-			}
+		if p.Depth < 0 {
+			return fmt.Errorf("depth must be a positive number, got %d", p.Depth)
 		}
 
+		var err error
+		if plugin.Watch[i].SkipPaths, err = stringList("skip_path", p.RawSkipPath); err != nil {
+			return err
+		}
+		if plugin.Watch[i].ExceptPaths, err = stringList("except_path", p.RawExceptPath); err != nil {
+			return err
+		}
+		if plugin.Watch[i].After, err = stringList("after", p.RawAfter); err != nil {
+			return err
+		}
+		plugin.Watch[i].RawAfter = nil
+
 		if p.RawConfig != nil {
 			b, err := json.Marshal(p.RawConfig)
 			if err != nil {
@@ -310,6 +626,10 @@ func (plugin *Plugin) UnmarshalJSON(data []byte) error {
 		}
 		plugin.Watch[i].RawConfig = nil
 
+		if err := validateMatrixPlaceholders(plugin.Watch[i].Steps, plugin.Watch[i]); err != nil {
+			return err
+		}
+
 		for j := range plugin.Watch[i].Steps {
 			step := &plugin.Watch[i].Steps[j]
 			if step.Trigger != "" {
@@ -320,7 +640,7 @@ func (plugin *Plugin) UnmarshalJSON(data []byte) error {
 			}
 		}
 
-		appendEnv(&plugin.Watch[i], plugin.Env)
+		appendEnv(&plugin.Watch[i], plugin.Env, osEnv)
 
 		// Attempt to parse the metadata after the env's
 		parsedMetadata, err := parseMetadata(plugin.Metadata)
@@ -334,9 +654,126 @@ func (plugin *Plugin) UnmarshalJSON(data []byte) error {
 		p.RawSkipPath = nil
 	}
 
+	if err := setWatchNames(plugin.Watch); err != nil {
+		return err
+	}
+
+	if err := validateGroupBy(plugin.GroupBy, plugin.Watch); err != nil {
+		return err
+	}
+
+	return validateAfter(plugin.Watch)
+}
+
+// setWatchNames names the watches without a name after their first path,
+// or "default" for the default config, adding a number to keep names
+// unique. Names given in the config must be unique.
+func setWatchNames(watches []WatchConfig) error {
+	taken := map[string]bool{}
+	for _, w := range watches {
+		if w.Name == "" {
+			continue
+		}
+		if taken[w.Name] {
+			return fmt.Errorf("duplicate watch name %q", w.Name)
+		}
+		taken[w.Name] = true
+	}
+
+	for i, w := range watches {
+		if w.Name != "" {
+			continue
+		}
+
+		id := watchID(w)
+		name := id
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s-%d", id, n)
+		}
+		taken[name] = true
+		watches[i].Name = name
+	}
+
 	return nil
 }
 
+// hasPaths reports whether w generates steps for the files matching its
+// paths, rather than being a default, always or uncovered config
+func (w WatchConfig) hasPaths() bool {
+	return w.Default == nil && w.Always == nil && w.Uncovered == nil
+}
+
+// parseShorthandConfig parses the steps of a default, always or uncovered
+// config, which can be written with or without a config attribute. It
+// returns nil when there are none.
+func parseShorthandConfig(raw interface{}) ([]Step, error) {
+	config, ok := raw.(map[string]interface{})
+	if !ok || len(config) == 0 {
+		return nil, nil
+	}
+
+	var conf interface{} = config
+	if nested, ok := config["config"]; ok {
+		conf = nested
+	}
+	b, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	switch conf.(type) {
+	case []interface{}:
+		var steps []Step
+		if err := json.Unmarshal(b, &steps); err != nil {
+			return nil, err
+		}
+		return steps, nil
+	default:
+		var step Step
+		if err := json.Unmarshal(b, &step); err != nil {
+			return nil, err
+		}
+		return []Step{step}, nil
+	}
+}
+
+// passesFiles reports whether any generated step may be passed its files
+func (plugin Plugin) passesFiles() bool {
+	if plugin.PassMatchedFiles || plugin.TriggerContext {
+		return true
+	}
+
+	for _, w := range plugin.Watch {
+		if w.Uncovered != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watchID derives the name of an unnamed watch
+func watchID(w WatchConfig) string {
+	switch {
+	case w.Default != nil:
+		return "default"
+	case w.Always != nil:
+		return "always"
+	case w.Uncovered != nil:
+		return "uncovered"
+	}
+
+	id := ""
+	if len(w.Paths) > 0 {
+		id = strings.Trim(invalidKeyChars.ReplaceAllString(w.Paths[0], "-"), "-")
+	}
+	if id == "" {
+		return "watch"
+	}
+
+	return id
+}
+
 func initializePlugin(data string) (Plugin, error) {
 	log.Debugf("parsing plugin config: %v", data)
 
@@ -457,6 +894,7 @@ func setBuild(build *Build) {
 
 	if build.Message == "" {
 		build.Message = escapeInterpolation(env("BUILDKITE_MESSAGE", ""))
+		build.DefaultMessage = true
 	}
 
 	if build.Branch == "" {
@@ -469,7 +907,7 @@ func setBuild(build *Build) {
 }
 
 // processNestedSteps recursively processes nested steps, handling environment variables and notify configurations
-func processNestedSteps(steps []Step, env map[string]string) {
+func processNestedSteps(steps []Step, env map[string]string, osEnv map[string]bool) {
 	for i := range steps {
 		// Parse the step's own env
 		steps[i].Env, _ = parseEnv(steps[i].RawEnv)
@@ -495,19 +933,21 @@ func processNestedSteps(steps []Step, env map[string]string) {
 			}
 		}
 
+		markEnvFromOS(&steps[i], env, osEnv)
+
 		// Clear RawEnv fields
 		steps[i].RawEnv = nil
 		steps[i].Build.RawEnv = nil
 
 		// Recursively process any nested steps
 		if len(steps[i].Steps) > 0 {
-			processNestedSteps(steps[i].Steps, env)
+			processNestedSteps(steps[i].Steps, env, osEnv)
 		}
 	}
 }
 
 // appends top level env to Step.Env and Step.Build.Env
-func appendEnv(watch *WatchConfig, env map[string]string) {
+func appendEnv(watch *WatchConfig, env map[string]string, osEnv map[string]bool) {
 	for i := range watch.Steps {
 		step := &watch.Steps[i]
 
@@ -533,11 +973,13 @@ func appendEnv(watch *WatchConfig, env map[string]string) {
 			}
 		}
 
+		markEnvFromOS(step, env, osEnv)
+
 		step.RawEnv = nil
 		step.Build.RawEnv = nil
 		// Process nested steps
 		if len(step.Steps) > 0 {
-			processNestedSteps(step.Steps, env)
+			processNestedSteps(step.Steps, env, osEnv)
 		}
 	}
 
@@ -545,6 +987,43 @@ func appendEnv(watch *WatchConfig, env map[string]string) {
 	watch.RawSkipPath = nil
 }
 
+// markEnvFromOS records the env and build env keys of step whose values
+// are read from the agent's environment rather than written in the config.
+// The top level env, with the keys of osEnv read from the environment, is
+// merged into the env of command steps and the build env of triggers, and
+// overrides the step's own there.
+func markEnvFromOS(step *Step, env map[string]string, osEnv map[string]bool) {
+	var stepEnv, buildEnv map[string]string
+	if step.Command != nil || step.Commands != nil {
+		stepEnv = env
+	} else if step.Trigger != "" {
+		buildEnv = env
+	}
+
+	step.EnvFromOS = keysFromOS(step.Env, envFromOS(step.RawEnv), stepEnv, osEnv)
+	step.Build.EnvFromOS = keysFromOS(step.Build.Env, envFromOS(step.Build.RawEnv), buildEnv, osEnv)
+}
+
+// keysFromOS returns the keys of values read from the environment, those
+// of own unless merged from env, where osEnv tells instead
+func keysFromOS(values map[string]string, own map[string]bool, env map[string]string, osEnv map[string]bool) map[string]bool {
+	var keys map[string]bool
+	for k := range values {
+		fromOS := own[k]
+		if _, ok := env[k]; ok {
+			fromOS = osEnv[k]
+		}
+		if fromOS {
+			if keys == nil {
+				keys = map[string]bool{}
+			}
+			keys[k] = true
+		}
+	}
+
+	return keys
+}
+
 // appends build metadata
 func appendMetadata(watch *WatchConfig, metadata map[string]string) {
 	if len(metadata) == 0 {
@@ -639,6 +1118,28 @@ func parseEnv(raw interface{}) (map[string]string, error) {
 	}
 }
 
+// envFromOS returns the keys of an env configuration that parseEnv reads
+// from the OS environment
+func envFromOS(raw interface{}) map[string]bool {
+	keys := map[string]bool{}
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if val == nil {
+				keys[strings.TrimSpace(k)] = true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if str, ok := item.(string); ok && !strings.Contains(str, "=") {
+				keys[strings.TrimSpace(str)] = true
+			}
+		}
+	}
+
+	return keys
+}
+
 // parse metadata in format from key:value to map[key] = value
 func parseMetadata(raw interface{}) (map[string]string, error) {
 	if raw == nil {
@@ -23,6 +23,7 @@ func defaultPluginWithDefault() Plugin {
 	ret := defaultPlugin()
 	ret.Watch = []WatchConfig{
 		{
+			Name:  "buildkite",
 			Paths: []string{".buildkite/**/*"},
 			Steps: []Step{{
 				Command: "echo hello world",
@@ -30,6 +31,7 @@ func defaultPluginWithDefault() Plugin {
 			}},
 		},
 		{
+			Name:    "default",
 			Default: true,
 			Paths:   []string{},
 			Steps: []Step{{
@@ -222,6 +224,7 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 		},
 		Watch: []WatchConfig{
 			{
+				Name:  "watch-path-1",
 				Paths: []string{"watch-path-1"},
 				Steps: []Step{{
 					Trigger: "service-2",
@@ -235,10 +238,12 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 							"env2": "env-2",
 							"env3": "env-3",
 						},
+						EnvFromOS: map[string]bool{"env3": true},
 					},
 				}},
 			},
 			{
+				Name:  "watch-path-1-2",
 				Paths: []string{"watch-path-1"},
 				Steps: []Step{{
 					Command: "echo hello-world",
@@ -249,7 +254,8 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 						"env4": "env-4",
 						"hi":   "bye",
 					},
-					SoftFail: []interface{}{map[string]interface{}{"exit_status": "*"}},
+					EnvFromOS: map[string]bool{"env3": true, "env4": true},
+					SoftFail:  []interface{}{map[string]interface{}{"exit_status": "*"}},
 					Retry: map[string]interface{}{
 						"automatic": []interface{}{
 							map[string]interface{}{"exit_status": float64(-1), "limit": float64(2)},
@@ -269,6 +275,7 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 				}},
 			},
 			{
+				Name:  "watch-path-1-3",
 				Paths: []string{"watch-path-1", "watch-path-2"},
 				Steps: []Step{{
 					Trigger: "service-1",
@@ -289,9 +296,10 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 							"env2": "env-2",
 							"env3": "env-3",
 						},
+						EnvFromOS: map[string]bool{"env3": true},
 					},
 					Async:         true,
-					Agents:        map[string]string{"queue": "queue-1", "database": "postgres"},
+					Agents:        Agent{"queue": "queue-1", "database": "postgres"},
 					ArtifactPaths: []string{"artifact-1"},
 					SoftFail: []interface{}{map[string]interface{}{
 						"exit_status": float64(127),
@@ -299,6 +307,7 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 				}},
 			},
 			{
+				Name:  "watch-path-1-4",
 				Paths: []string{"watch-path-1"},
 				Steps: []Step{{
 					Group:   "my group",
@@ -308,10 +317,12 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 						"env2": "env-2",
 						"env3": "env-3",
 					},
-					SoftFail: true,
+					EnvFromOS: map[string]bool{"env3": true},
+					SoftFail:  true,
 				}},
 			},
 			{
+				Name:  "watch-path-3",
 				Paths: []string{"watch-path-3"},
 				Steps: []Step{{
 					Group: "my group",
@@ -323,6 +334,7 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 								"env2": "env-2",
 								"env3": "env-3",
 							},
+							EnvFromOS: map[string]bool{"env3": true},
 						},
 						{
 							Command: "echo hello-group from second step",
@@ -331,6 +343,7 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 								"env2": "env-2",
 								"env3": "env-3",
 							},
+							EnvFromOS: map[string]bool{"env3": true},
 						},
 					},
 				}},
@@ -545,13 +558,15 @@ func TestPluginWithBuildConfigFromEnv(t *testing.T) {
 		Interpolation: true,
 		Watch: []WatchConfig{
 			{
+				Name:  "buildkite",
 				Paths: []string{".buildkite/**/*"},
 				Steps: []Step{{
 					Trigger: "foo-service",
 					Build: Build{
-						Message: "fix: temp file not correctly deleted",
-						Branch:  "go-rewrite",
-						Commit:  "123",
+						Message:        "fix: temp file not correctly deleted",
+						DefaultMessage: true,
+						Branch:         "go-rewrite",
+						Commit:         "123",
 					},
 				}},
 			},
@@ -630,24 +645,28 @@ func TestPluginWithMultiplePluginVersions(t *testing.T) {
 		Interpolation: true,
 		Watch: []WatchConfig{
 			{
+				Name:  "foo-service",
 				Paths: []string{"foo-service/"},
 				Steps: []Step{{
 					Trigger: "foo-service",
 					Build: Build{
-						Message: "fix: temp file not correctly deleted",
-						Branch:  "go-rewrite",
-						Commit:  "123",
+						Message:        "fix: temp file not correctly deleted",
+						DefaultMessage: true,
+						Branch:         "go-rewrite",
+						Commit:         "123",
 					},
 				}},
 			},
 			{
+				Name:  "bar-service",
 				Paths: []string{"bar-service/"},
 				Steps: []Step{{
 					Trigger: "foo-service",
 					Build: Build{
-						Message: "fix: temp file not correctly deleted",
-						Branch:  "go-rewrite",
-						Commit:  "123",
+						Message:        "fix: temp file not correctly deleted",
+						DefaultMessage: true,
+						Branch:         "go-rewrite",
+						Commit:         "123",
 					},
 				}},
 			},
@@ -686,6 +705,7 @@ func TestPluginShouldPreserveStepPlugins(t *testing.T) {
 		Interpolation: true,
 		Watch: []WatchConfig{
 			{
+				Name:  "buildkite",
 				Paths: []string{".buildkite/**/*"},
 				Steps: []Step{{
 					Plugins: []map[string]interface{}{
@@ -726,6 +746,7 @@ func TestPluginShouldPreserveStepBranches(t *testing.T) {
 		Interpolation: true,
 		Watch: []WatchConfig{
 			{
+				Name:  "buildkite",
 				Paths: []string{".buildkite/**/*"},
 				Steps: []Step{{
 					Branches: "!main feature/*",
@@ -780,13 +801,15 @@ func TestPluginMetadataOnlyAppliedToTriggerSteps(t *testing.T) {
 		},
 		Watch: []WatchConfig{
 			{
+				Name:  "app",
 				Paths: []string{"app/"},
 				Steps: []Step{{
 					Trigger: "app-deploy",
 					Build: Build{
-						Message: "fix: temp file not correctly deleted",
-						Branch:  "go-rewrite",
-						Commit:  "123",
+						Message:        "fix: temp file not correctly deleted",
+						DefaultMessage: true,
+						Branch:         "go-rewrite",
+						Commit:         "123",
 						Metadata: map[string]string{
 							"step_level_key":   "step_level_value",
 							"plugin_level_key": "plugin_level_value",
@@ -795,6 +818,7 @@ func TestPluginMetadataOnlyAppliedToTriggerSteps(t *testing.T) {
 				}},
 			},
 			{
+				Name:  "test",
 				Paths: []string{"test/"},
 				Steps: []Step{{
 					Command: "echo test command",
@@ -887,6 +911,7 @@ func TestPluginShouldPreserveStepCondition(t *testing.T) {
 		Interpolation: true,
 		Watch: []WatchConfig{
 			{
+				Name:  "service",
 				Paths: []string{"service/**/*"},
 				Steps: []Step{{
 					Command:   "echo deploy",
@@ -1029,6 +1054,7 @@ func TestPluginShouldPreserveDependsOnString(t *testing.T) {
 		Interpolation: true,
 		Watch: []WatchConfig{
 			{
+				Name:  "service",
 				Paths: []string{"service/**/*"},
 				Steps: []Step{{
 					Command:   "echo deploy",
@@ -1068,13 +1094,15 @@ func TestPluginShouldPreserveDependsOnArray(t *testing.T) {
 		Interpolation: true,
 		Watch: []WatchConfig{
 			{
+				Name:  "service",
 				Paths: []string{"service/**/*"},
 				Steps: []Step{{
 					Trigger: "deploy-pipeline",
 					Build: Build{
-						Message: "fix: temp file not correctly deleted",
-						Branch:  "go-rewrite",
-						Commit:  "123",
+						Message:        "fix: temp file not correctly deleted",
+						DefaultMessage: true,
+						Branch:         "go-rewrite",
+						Commit:         "123",
 					},
 					DependsOn: []interface{}{"build-step", "test-step"},
 				}},
@@ -1123,6 +1151,7 @@ func TestPluginEnvWithEqualsSignsAndSpacesInValues(t *testing.T) {
 		},
 		Watch: []WatchConfig{
 			{
+				Name:  "services",
 				Paths: []string{"services/"},
 				Steps: []Step{{
 					Command: "echo test",
@@ -1176,6 +1205,7 @@ func TestPluginShouldPreserveSecretsAsMap(t *testing.T) {
 		Interpolation: true,
 		Watch: []WatchConfig{
 			{
+				Name:  "service",
 				Paths: []string{"service/**/*"},
 				Steps: []Step{{
 					Command: "echo deploy",
@@ -1218,6 +1248,7 @@ func TestPluginShouldPreserveSecretsAsArray(t *testing.T) {
 		Interpolation: true,
 		Watch: []WatchConfig{
 			{
+				Name:  "service",
 				Paths: []string{"service/**/*"},
 				Steps: []Step{{
 					Command: "echo deploy",
@@ -1308,6 +1339,7 @@ func TestPluginAcceptsArtifactPathsFieldName(t *testing.T) {
 		Interpolation: true,
 		Watch: []WatchConfig{
 			{
+				Name:  "service",
 				Paths: []string{"service/**/*"},
 				Steps: []Step{{
 					Command:       "echo test",
@@ -1754,6 +1786,32 @@ func TestStepIsValid_WithTrigger(t *testing.T) {
 	assert.True(t, step.isValid())
 }
 
+func TestStepIsValid_WithBlock(t *testing.T) {
+	step := Step{Block: ":rocket: Deploy to production?"}
+	assert.True(t, step.isValid())
+}
+
+func TestStepIsValid_WithInput(t *testing.T) {
+	step := Step{Input: "Release details"}
+	assert.True(t, step.isValid())
+}
+
+func TestStepIsValid_OnlyPrompt(t *testing.T) {
+	step := Step{Prompt: "Are you sure?", Key: "confirm"}
+	assert.False(t, step.isValid())
+}
+
+func TestStepIsValid_GroupWithBlock(t *testing.T) {
+	step := Step{
+		Group: "deploy",
+		Steps: []Step{
+			{Block: "Release?", Key: "release-gate"},
+			{Trigger: "deploy-production", DependsOn: "release-gate"},
+		},
+	}
+	assert.True(t, step.isValid())
+}
+
 func TestStepIsValid_GroupWithCommand(t *testing.T) {
 	step := Step{
 		Group:   "deploy",
@@ -1911,7 +1969,7 @@ func TestPluginConfigArrayProducesMultipleSteps(t *testing.T) {
 
 	// stepsToTrigger / pipeline generation should produce both as separate
 	// top-level steps, not nested under a group, when the path matches.
-	steps, err := stepsToTrigger([]string{"services/main.go"}, got.Watch)
+	steps, err := stepsToTrigger([]string{"services/main.go"}, got)
 	assert.NoError(t, err)
 	assert.Len(t, steps, 2)
 	assert.Equal(t, "", steps[0].Group)
@@ -1941,3 +1999,382 @@ func TestStepMatrixRoundTripsToYAML(t *testing.T) {
 	assert.Contains(t, yamlStr, "- linux")
 	assert.Contains(t, yamlStr, "- windows")
 }
+
+func TestStepPassesThroughUnknownAttributes(t *testing.T) {
+	data := []byte(`{
+		"command": "make test",
+		"timeout_in_minutes": 10,
+		"parallelism": 4,
+		"concurrency": 1,
+		"concurrency_group": "deploy/production",
+		"priority": -1,
+		"skip": "Skipped until flaky tests are fixed",
+		"cancel_on_build_failing": true,
+		"branches": ["main", "release/*"],
+		"agents": {"queue": "deploy", "spot": false, "cpus": 8}
+	}`)
+
+	var step Step
+	err := json.Unmarshal(data, &step)
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"timeout_in_minutes":      int64(10),
+		"parallelism":             int64(4),
+		"concurrency":             int64(1),
+		"concurrency_group":       "deploy/production",
+		"priority":                int64(-1),
+		"skip":                    "Skipped until flaky tests are fixed",
+		"cancel_on_build_failing": true,
+	}, step.Extra)
+
+	out, err := yaml.Marshal(step)
+	assert.NoError(t, err)
+
+	want := `branches:
+    - main
+    - release/*
+command: make test
+agents:
+    cpus: 8
+    queue: deploy
+    spot: false
+cancel_on_build_failing: true
+concurrency: 1
+concurrency_group: deploy/production
+parallelism: 4
+priority: -1
+skip: Skipped until flaky tests are fixed
+timeout_in_minutes: 10
+`
+	assert.Equal(t, want, string(out))
+}
+
+func TestGroupStepPassesThroughUnknownAttributes(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{
+				"path": "services/",
+				"config": [
+					{
+						"group": "Deploy",
+						"future_group_attribute": "kept",
+						"steps": [{ "command": "deploy.sh", "timeout_in_minutes": 30 }]
+					},
+					{
+						"group": "Lint",
+						"command": "lint.sh",
+						"soft_fail": true,
+						"priority": 2
+					}
+				]
+			}]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+
+	out, err := yaml.Marshal(got.Watch[0].Steps)
+	assert.NoError(t, err)
+
+	want := `- group: Deploy
+  steps:
+    - command: deploy.sh
+      timeout_in_minutes: 30
+  future_group_attribute: kept
+- group: Lint
+  steps:
+    - command: lint.sh
+      soft_fail: true
+      priority: 2
+`
+	assert.Equal(t, want, string(out))
+}
+
+func TestPluginWithWaitObject(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{ "path": "foo", "config": { "command": "echo foo" } }],
+			"wait": {
+				"continue_on_failure": true,
+				"if": "build.branch == 'main'",
+				"depends_on": ["tests"],
+				"allow_dependency_failure": true
+			}
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+
+	assert.True(t, got.Wait)
+	assert.Nil(t, got.RawWait)
+	assert.Equal(t, WaitStep{
+		ContinueOnFailure:      true,
+		Condition:              "build.branch == 'main'",
+		DependsOn:              []interface{}{"tests"},
+		AllowDependencyFailure: true,
+	}, got.WaitConfig)
+}
+
+func TestStepWaitAttributes(t *testing.T) {
+	var step Step
+	err := json.Unmarshal([]byte(`{
+		"wait": { "continue_on_failure": true, "depends_on": "tests" },
+		"key": "barrier",
+		"allow_dependency_failure": true
+	}`), &step)
+	assert.NoError(t, err)
+
+	assert.Equal(t, &WaitStep{ContinueOnFailure: true}, step.Wait)
+	assert.Equal(t, "barrier", step.Key)
+	assert.Equal(t, "tests", step.DependsOn)
+	assert.True(t, step.AllowDependencyFailure)
+	assert.Nil(t, step.Extra)
+	assert.True(t, step.isValid())
+
+	err = json.Unmarshal([]byte(`"block"`), &step)
+	assert.EqualError(t, err, `unsupported step "block"`)
+}
+
+func TestWaitStepRoundTripsToYAML(t *testing.T) {
+	var step Step
+	err := json.Unmarshal([]byte(`{
+		"wait": { "branches": "main" },
+		"key": "barrier",
+		"priority": 2
+	}`), &step)
+	assert.NoError(t, err)
+
+	out, err := yaml.Marshal(step)
+	assert.NoError(t, err)
+	assert.Equal(t, "wait: null\nkey: barrier\nbranches: main\npriority: 2\n", string(out))
+}
+
+func TestTriggerBuildRoundTripsToYAML(t *testing.T) {
+	var step Step
+	err := json.Unmarshal([]byte(`{
+		"trigger": "deploy",
+		"build": { "message": "Deploy", "label": { "tier": 1 } }
+	}`), &step)
+	assert.NoError(t, err)
+
+	out, err := yaml.Marshal(step)
+	assert.NoError(t, err)
+	assert.Equal(t, "trigger: deploy\nbuild:\n    message: Deploy\n    label:\n        tier: 1\n", string(out))
+}
+
+func TestPluginWatchNames(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{ "path": "services/api/", "config": { "command": "echo api" } },
+				{ "path": ["services/api/**/*.go", "lib/"], "config": { "command": "echo go" } },
+				{ "name": "services-api-2", "path": "docs/", "config": { "command": "echo docs" } },
+				{ "path": "services/api", "config": { "command": "echo api again" } },
+				{ "default": { "config": { "command": "echo default" } } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+
+	names := []string{}
+	for _, w := range got.Watch {
+		names = append(names, w.Name)
+	}
+	assert.Equal(t, []string{"services-api", "services-api-go", "services-api-2", "services-api-3", "default"}, names)
+}
+
+func TestPluginRejectsDuplicateWatchNames(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{ "name": "api", "path": "services/api/", "config": { "command": "echo api" } },
+				{ "name": "api", "path": "lib/", "config": { "command": "echo lib" } }
+			]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, `duplicate watch name "api"`)
+}
+
+func TestPluginWithAlwaysAndUncovered(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{ "path": "services/", "config": { "command": "make" } },
+				{ "always": { "command": "make lint" } },
+				{ "uncovered": { "config": [{ "command": "./check-ownership.sh" }] } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+	assert.Equal(t, "always", got.Watch[1].Name)
+	assert.Equal(t, true, got.Watch[1].Always)
+	assert.Equal(t, []string{}, got.Watch[1].Paths)
+	assert.Equal(t, []Step{{Command: "make lint"}}, got.Watch[1].Steps)
+	assert.Equal(t, "uncovered", got.Watch[2].Name)
+	assert.Equal(t, []Step{{Command: "./check-ownership.sh"}}, got.Watch[2].Steps)
+
+	param = `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{ "always": { "command": "make lint" }, "default": { "command": "echo" } }]
+		}
+	}]`
+
+	_, err = initializePlugin(param)
+	assert.EqualError(t, err, "a watch can only have one of default, always and uncovered")
+}
+
+func TestPluginWithFailOnUncovered(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"fail_on_uncovered": true,
+			"ignore_uncovered": ["*.md", ".github/"],
+			"watch": [{ "path": "services/", "config": { "command": "make" } }]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+	assert.True(t, got.FailOnUncovered)
+	assert.Equal(t, []string{"*.md", ".github/"}, got.IgnoreUncovered)
+	assert.Nil(t, got.RawIgnoreUncovered)
+
+	_, err = initializePlugin(`[{"monorepo-diff": {"ignore_uncovered": ["*.md", 1]}}]`)
+	assert.EqualError(t, err, "ignore_uncovered entries must be strings, got 1")
+}
+
+func TestPluginWithOutput(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"output": "file",
+			"output_path": "pipeline.yml",
+			"watch": [{ "path": "services/", "config": { "command": "make" } }]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+	assert.Equal(t, outputFile, got.Output)
+	assert.Equal(t, "pipeline.yml", got.OutputPath)
+
+	_, err = initializePlugin(`[{"monorepo-diff": {"output": "file"}}]`)
+	assert.EqualError(t, err, `output "file" requires output_path`)
+
+	_, err = initializePlugin(`[{"monorepo-diff": {"output": "s3"}}]`)
+	assert.EqualError(t, err, `unsupported output value "s3", expected "agent", "stdout", "file" or "json"`)
+}
+
+func TestPluginWithAnnotate(t *testing.T) {
+	got, err := initializePlugin(`[{"monorepo-diff": {"annotate": true}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, &Annotation{Style: "info", Context: "monorepo-diff"}, got.Annotate)
+	assert.Nil(t, got.RawAnnotate)
+
+	got, err = initializePlugin(`[{"monorepo-diff": {"annotate": {"style": "success"}}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, &Annotation{Style: "success", Context: "monorepo-diff"}, got.Annotate)
+
+	got, err = initializePlugin(`[{"monorepo-diff": {"annotate": false}}]`)
+	assert.NoError(t, err)
+	assert.Nil(t, got.Annotate)
+
+	_, err = initializePlugin(`[{"monorepo-diff": {"annotate": {"style": "loud"}}}]`)
+	assert.EqualError(t, err, `unsupported annotate style "loud", expected "success", "info", "warning" or "error"`)
+}
+
+func TestPluginWithRecordMetadata(t *testing.T) {
+	got, err := initializePlugin(`[{"monorepo-diff": {"record_meta_data": true}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, &ResultMetadata{Prefix: "monorepo-diff-"}, got.RecordMetadata)
+	assert.Nil(t, got.RawRecordMetadata)
+
+	got, err = initializePlugin(`[{"monorepo-diff": {"record_meta_data": {"prefix": "api-", "keys": {"watches": "matched"}}}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, &ResultMetadata{Prefix: "api-", Keys: map[string]string{"watches": "matched"}}, got.RecordMetadata)
+
+	_, err = initializePlugin(`[{"monorepo-diff": {"record_meta_data": {"keys": {"files": "changed"}}}}]`)
+	assert.EqualError(t, err, `unsupported record_meta_data key "files", expected "watches", "triggers", "changed_files" or "diff_base"`)
+}
+
+func TestPluginWithLogFormatAndLevel(t *testing.T) {
+	got, err := initializePlugin(`[{"monorepo-diff": {"log_format": "json", "log_level": "trace"}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, "json", got.LogFormat)
+	assert.Equal(t, "trace", got.LogLevel)
+
+	// unknown levels fall back to info when the logger is set up
+	for _, level := range []string{"debug", "info", "warn", "warning", "error", "ERROR", "fatal", "verbose"} {
+		_, err := initializePlugin(`[{"monorepo-diff": {"log_level": "` + level + `"}}]`)
+		assert.NoError(t, err, level)
+	}
+
+	_, err = initializePlugin(`[{"monorepo-diff": {"log_format": "logfmt"}}]`)
+	assert.EqualError(t, err, `unsupported log_format value "logfmt", expected "text" or "json"`)
+}
+
+func TestPluginWithUploadOptions(t *testing.T) {
+	got, err := initializePlugin(`[{"monorepo-diff": {}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, got.UploadRetries)
+	assert.Nil(t, got.UploadArgs)
+
+	got, err = initializePlugin(`[{"monorepo-diff": {
+		"replace": true,
+		"reject_secrets": true,
+		"jwks_file": "/etc/buildkite/jwks.json",
+		"jwks_key_id": "pipeline-signing",
+		"upload_args": ["--dry-run", "--format=yaml"],
+		"upload_retries": 3
+	}}]`)
+	assert.NoError(t, err)
+	assert.True(t, got.Replace)
+	assert.True(t, got.RejectSecrets)
+	assert.Equal(t, "/etc/buildkite/jwks.json", got.JWKSFile)
+	assert.Equal(t, "pipeline-signing", got.JWKSKeyID)
+	assert.Equal(t, []string{"--dry-run", "--format=yaml"}, got.UploadArgs)
+	assert.Nil(t, got.RawUploadArgs)
+	assert.Equal(t, 3, got.UploadRetries)
+
+	got, err = initializePlugin(`[{"monorepo-diff": {"upload_args": "--dry-run"}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--dry-run"}, got.UploadArgs)
+
+	_, err = initializePlugin(`[{"monorepo-diff": {"upload_args": ["--dry-run", 1]}}]`)
+	assert.EqualError(t, err, "upload_args entries must be strings, got 1")
+
+	_, err = initializePlugin(`[{"monorepo-diff": {"upload_retries": -1}}]`)
+	assert.EqualError(t, err, "upload_retries must be a positive number, got -1")
+}
+
+func TestPluginWithUploadLimits(t *testing.T) {
+	got, err := initializePlugin(`[{"monorepo-diff": {"upload_max_steps": 500, "upload_max_size": 1048576}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, 500, got.UploadMaxSteps)
+	assert.Equal(t, 1048576, got.UploadMaxSize)
+
+	_, err = initializePlugin(`[{"monorepo-diff": {"upload_max_steps": -1}}]`)
+	assert.EqualError(t, err, "upload_max_steps must be a positive number, got -1")
+
+	_, err = initializePlugin(`[{"monorepo-diff": {"upload_max_size": -1}}]`)
+	assert.EqualError(t, err, "upload_max_size must be a positive number, got -1")
+}
+
+func TestPluginRejectsNonStringWatchPaths(t *testing.T) {
+	for field, watch := range map[string]string{
+		"path":        `{ "path": ["services/", 1], "config": { "command": "make" } }`,
+		"skip_path":   `{ "path": "services/", "skip_path": [1], "config": { "command": "make" } }`,
+		"except_path": `{ "path": "services/", "except_path": [1], "config": { "command": "make" } }`,
+		"after":       `{ "path": "services/", "after": [1], "config": { "command": "make" } }`,
+	} {
+		_, err := initializePlugin(`[{"monorepo-diff": {"watch": [` + watch + `]}}]`)
+		assert.EqualError(t, err, field+" entries must be strings, got 1")
+	}
+}
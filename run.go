@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runPipelineCommand runs the diff of a plugin config against the working
+// copy and writes the pipeline it generates, without a Buildkite agent
+func runPipelineCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	config := flags.String("config", ".buildkite/pipeline.yml", "pipeline or plugin config file")
+	step := flags.String("step", "", "label or key of the plugin step, when the pipeline has several")
+	diffCommand := flags.String("diff", "", "diff command to run instead of the configured one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	plugin, err := loadConfig(*config, *step)
+	if err != nil {
+		return err
+	}
+
+	setupLogger(plugin.LogLevel, plugin.LogFormat)
+
+	if *diffCommand != "" {
+		plugin.Diff = *diffCommand
+	}
+
+	result, skip, err := diffSteps(&plugin)
+	if err != nil || skip {
+		return err
+	}
+
+	data, hasSteps, err := marshalPipeline(escapeMatchedFiles(result.Steps, plugin.Interpolation), plugin)
+	if err != nil {
+		return err
+	}
+
+	if !hasSteps {
+		log.Info("No steps generated.")
+		return nil
+	}
+
+	_, err = out.Write(data)
+
+	return err
+}
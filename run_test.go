@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const runPipeline = `steps:
+  - label: "Services"
+    plugins:
+      - monorepo-diff#v1.0.0:
+          watch:
+            - path: services/api/
+              config:
+                command: make api
+  - key: docs
+    plugins:
+      - monorepo-diff#v1.0.0:
+          wait: true
+          watch:
+            - path: docs/
+              config:
+                command: make docs
+`
+
+func TestRunPipelineCommand(t *testing.T) {
+	config := writeConfig(t, runPipeline)
+
+	var out bytes.Buffer
+	err := runCommand([]string{"run", "--config", config, "--step", "docs", "--diff", "echo docs/index.md"}, &out)
+	require.NoError(t, err)
+
+	assert.Equal(t, `steps:
+    - command: make docs
+    - wait: null
+`, out.String())
+}
+
+func TestRunPipelineCommandEscapesMatchedFiles(t *testing.T) {
+	config := writeConfig(t, `steps:
+  - plugins:
+      - monorepo-diff#v1.0.0:
+          pass_matched_files: true
+          watch:
+            - path: docs/
+              config:
+                command: make docs
+`)
+
+	var out bytes.Buffer
+	err := runCommand([]string{"run", "--config", config, "--diff", "echo 'docs/$index.md'"}, &out)
+	require.NoError(t, err)
+
+	assert.Equal(t, `steps:
+    - command: make docs
+      env:
+        MONOREPO_DIFF_MATCHED_FILES: docs/$$index.md
+`, out.String())
+}
+
+func TestRunPipelineCommandNoSteps(t *testing.T) {
+	config := writeConfig(t, runPipeline)
+
+	var out bytes.Buffer
+	err := runCommand([]string{"run", "--config", config, "--diff", "echo docs/index.md"}, &out)
+	require.NoError(t, err)
+
+	assert.Empty(t, out.String())
+}
+
+func TestRunPipelineCommandUnknownStep(t *testing.T) {
+	config := writeConfig(t, runPipeline)
+
+	err := runCommand([]string{"run", "--config", config, "--step", "deploy"}, &bytes.Buffer{})
+	assert.EqualError(t, err, `no step "deploy" using the monorepo-diff plugin found in `+config)
+}
+
+func TestCommandFlagErrorsStayOutOfOutput(t *testing.T) {
+	for _, command := range []string{"run", "explain", "validate"} {
+		var out bytes.Buffer
+		err := runCommand([]string{command, "--unknown"}, &out)
+		assert.EqualError(t, err, "flag provided but not defined: -unknown")
+		assert.Empty(t, out.String(), command)
+	}
+}
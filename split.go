@@ -0,0 +1,165 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// pipelineHeader is what marshalPipeline writes before the steps of a
+// pipeline without notifications
+const pipelineHeader = "steps:\n"
+
+// splitsPipeline is true when the generated pipeline of plugin is split
+// into several uploads once it passes upload_max_steps or upload_max_size.
+// Only uploads to the build are split, the other outputs write a single
+// pipeline.
+func (plugin Plugin) splitsPipeline() bool {
+	if plugin.UploadMaxSteps == 0 && plugin.UploadMaxSize == 0 {
+		return false
+	}
+
+	return plugin.Output == "" || plugin.Output == outputAgent
+}
+
+// splitSteps returns steps in chunks that each stay within the
+// upload_max_steps and upload_max_size of plugin, to be uploaded in order.
+// The last chunk is uploaded with the wait step, hooks and notifications
+// of plugin, so its limits include them and it can hold no steps at all.
+// Groups are never split, and a chunk never ends between a step and a
+// later one it depends on, so every depends_on refers to a step that is
+// already uploaded. A step or group passing the limits on its own gets a
+// chunk of its own.
+func splitSteps(steps []Step, plugin Plugin) ([][]Step, error) {
+	if !plugin.splitsPipeline() {
+		return [][]Step{steps}, nil
+	}
+
+	// each step is measured as it is written in the steps of a pipeline,
+	// so a chunk is the header followed by its steps
+	sizes := make([]int, len(steps))
+	for i, step := range steps {
+		data, _, err := marshalPipeline([]Step{step}, Plugin{})
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = len(data) - len(pipelineHeader)
+	}
+
+	// the trailer is what the wait step, hooks and notifications add
+	trailer := 0
+	if len(steps) > 0 {
+		with, _, err := marshalPipeline(steps[:1], plugin)
+		if err != nil {
+			return nil, err
+		}
+		trailer = len(with) - len(pipelineHeader) - sizes[0]
+	}
+	trailerCount := len(plugin.Hooks)
+	if plugin.Wait {
+		trailerCount++
+	}
+
+	fits := func(count, size int) bool {
+		return (plugin.UploadMaxSteps == 0 || count <= plugin.UploadMaxSteps) &&
+			(plugin.UploadMaxSize == 0 || size <= plugin.UploadMaxSize)
+	}
+
+	// later holds the steps depended on by the steps of the current chunk
+	// that aren't in it yet
+	keys := stepKeys(steps)
+	later := map[int]bool{}
+
+	chunks := [][]Step{}
+	start, count, size := 0, 0, len(pipelineHeader)
+	for i, step := range steps {
+		if i > start && len(later) == 0 && !fits(count+jobCount(step), size+sizes[i]) {
+			chunks = append(chunks, steps[start:i])
+			start, count, size = i, 0, len(pipelineHeader)
+		}
+		delete(later, i)
+
+		count += jobCount(step)
+		size += sizes[i]
+		if !fits(count, size) {
+			log.WithField("phase", phaseUpload).Warnf("upload of step %q passes the upload limits with %d steps and %d bytes, uploading it as is", stepName(step), count, size)
+		}
+
+		for _, key := range stepDependencies(step) {
+			if j, ok := keys[key]; ok && j > i {
+				later[j] = true
+			}
+		}
+	}
+
+	if start < len(steps) && !fits(count+trailerCount, size+trailer) {
+		chunks = append(chunks, steps[start:])
+		start = len(steps)
+	}
+
+	return append(chunks, steps[start:]), nil
+}
+
+// jobCount returns the number of steps step counts for in an upload, a
+// group counting its nested steps
+func jobCount(step Step) int {
+	if step.Steps == nil {
+		return 1
+	}
+
+	count := 0
+	for _, s := range step.Steps {
+		count += jobCount(s)
+	}
+
+	return max(count, 1)
+}
+
+// stepKeys maps the keys of steps, and of the steps nested in them, to the
+// index of the top level step they belong to
+func stepKeys(steps []Step) map[string]int {
+	keys := map[string]int{}
+
+	var add func(step Step, i int)
+	add = func(step Step, i int) {
+		if step.Key != "" {
+			keys[step.Key] = i
+		}
+		for _, s := range step.Steps {
+			add(s, i)
+		}
+	}
+
+	for i, step := range steps {
+		add(step, i)
+	}
+
+	return keys
+}
+
+// stepDependencies returns the keys the depends_on of step and of the
+// steps nested in it refer to
+func stepDependencies(step Step) []string {
+	keys := []string{}
+	for _, d := range dependsOnList(step.DependsOn) {
+		if key := dependencyKey(d); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, s := range step.Steps {
+		keys = append(keys, stepDependencies(s)...)
+	}
+
+	return keys
+}
+
+// dependencyKey returns the key a depends_on entry refers to, given as the
+// key or as a step attribute
+func dependencyKey(d interface{}) string {
+	if m, ok := d.(map[string]interface{}); ok {
+		d = m["step"]
+	}
+
+	key, _ := isString(d)
+
+	return key
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitStepsWithoutLimits(t *testing.T) {
+	steps := []Step{{Command: "a"}, {Command: "b"}, {Command: "c"}}
+
+	chunks, err := splitSteps(steps, Plugin{})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Step{steps}, chunks)
+
+	chunks, err = splitSteps(steps, Plugin{UploadMaxSteps: 1, Output: outputStdout})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Step{steps}, chunks)
+}
+
+func TestSplitStepsByCount(t *testing.T) {
+	steps := []Step{
+		{Command: "a"},
+		{Group: "group", Steps: []Step{{Command: "b1"}, {Command: "b2"}}},
+		{Command: "c"},
+		{Command: "d"},
+	}
+
+	chunks, err := splitSteps(steps, Plugin{UploadMaxSteps: 2})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Step{steps[:1], steps[1:2], steps[2:]}, chunks)
+}
+
+func TestSplitStepsKeepsGroupsWhole(t *testing.T) {
+	steps := []Step{
+		{Command: "a"},
+		{Group: "group", Steps: []Step{{Command: "b1"}, {Command: "b2"}, {Command: "b3"}}},
+		{Command: "c"},
+	}
+
+	chunks, err := splitSteps(steps, Plugin{UploadMaxSteps: 2})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Step{steps[:1], steps[1:2], steps[2:]}, chunks)
+}
+
+func TestSplitStepsKeepsDependenciesUploaded(t *testing.T) {
+	steps := []Step{
+		{Command: "a", DependsOn: []interface{}{map[string]interface{}{"step": "c"}}},
+		{Command: "b"},
+		{Command: "c", Key: "c"},
+		{Command: "d", DependsOn: "a"},
+	}
+
+	chunks, err := splitSteps(steps, Plugin{UploadMaxSteps: 1})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Step{steps[:3], steps[3:]}, chunks)
+}
+
+func TestSplitStepsTrailer(t *testing.T) {
+	steps := []Step{{Command: "a"}, {Command: "b"}}
+
+	chunks, err := splitSteps(steps, Plugin{UploadMaxSteps: 2, Wait: true})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Step{steps, {}}, chunks)
+
+	chunks, err = splitSteps(steps, Plugin{UploadMaxSteps: 3, Wait: true})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Step{steps}, chunks)
+}
+
+func TestSplitStepsBySize(t *testing.T) {
+	steps := []Step{{Command: "make a"}, {Command: "make b"}, {Command: "make c"}}
+
+	// "steps:\n" and 22 bytes per "    - command: make a\n"
+	chunks, err := splitSteps(steps, Plugin{UploadMaxSize: 51})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Step{steps[:2], steps[2:]}, chunks)
+	assertChunkSizes(t, chunks, Plugin{UploadMaxSize: 51})
+
+	chunks, err = splitSteps(steps, Plugin{UploadMaxSize: 50})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Step{steps[:1], steps[1:2], steps[2:]}, chunks)
+}
+
+func TestSplitStepsBySizeOfMarshalledChunks(t *testing.T) {
+	steps := []Step{
+		{Command: "make a", Env: map[string]string{"TARGET": "services/api"}},
+		{Group: "deploy", Key: "deploy", Steps: []Step{{Trigger: "deploy-api", Build: Build{Message: "Deploy api"}}, {Command: "make smoke"}}},
+		{Command: []interface{}{"make lint", "make test"}, Agents: Agent{"queue": "linux"}},
+		{Command: "make c", DependsOn: "deploy"},
+		{Label: "Docs", Command: "make docs"},
+	}
+
+	plugin := Plugin{
+		UploadMaxSize: 200,
+		Wait:          true,
+		Hooks:         []HookConfig{{Command: "echo done"}},
+		Notify:        []PluginNotify{{Email: "dev@example.com"}},
+	}
+
+	chunks, err := splitSteps(steps, plugin)
+	require.NoError(t, err)
+	require.Greater(t, len(chunks), 1)
+	assert.Equal(t, steps, slices.Concat(chunks...))
+	assertChunkSizes(t, chunks, plugin)
+}
+
+// assertChunkSizes checks each chunk is within the size limit of plugin
+// once marshalled the way uploadPipeline uploads it
+func assertChunkSizes(t *testing.T, chunks [][]Step, plugin Plugin) {
+	t.Helper()
+
+	for i, chunk := range chunks {
+		chunkPlugin := plugin
+		if i < len(chunks)-1 {
+			chunkPlugin.Wait, chunkPlugin.Hooks, chunkPlugin.Notify = false, nil, nil
+		}
+
+		data, _, err := marshalPipeline(chunk, chunkPlugin)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(data), plugin.UploadMaxSize, "chunk %d:\n%s", i, data)
+	}
+}
+
+func TestUploadPipelineSplits(t *testing.T) {
+	plugin := Plugin{
+		Diff:           "echo services/api/main.go",
+		UploadMaxSteps: 3,
+		Wait:           true,
+		Hooks:          []HookConfig{{Command: "echo done"}},
+		Notify:         []PluginNotify{{Email: "dev@example.com"}},
+		Watch: []WatchConfig{{
+			Name:  "api",
+			Paths: []string{"services/api/"},
+			Steps: []Step{{Command: "make a"}, {Command: "make b"}, {Command: "make c"}, {Command: "make d"}},
+		}},
+	}
+
+	uploader := &recordingUploader{}
+	require.NoError(t, uploadPipeline(plugin, generatePipeline, uploader))
+
+	assert.Equal(t, []string{
+		"steps:\n    - command: make a\n    - command: make b\n    - command: make c\n",
+		"notify:\n    - email: dev@example.com\nsteps:\n    - command: make d\n    - wait: null\n    - command: echo done\n",
+	}, uploader.pipelines)
+}
+
+func TestAppendingUploader(t *testing.T) {
+	assert.Equal(t, agentUploader{rejectSecrets: true}, appendingUploader(agentUploader{replace: true, rejectSecrets: true}))
+	assert.Equal(t, fileUploader{path: "pipeline.yml"}, appendingUploader(fileUploader{path: "pipeline.yml"}))
+}
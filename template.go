@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// templateData is the data available to templates in generated step fields.
+type templateData struct {
+	// Watch is the name of the watch that generated the step
+	Watch string
+	// MatchedFiles are the changed files that matched the watch
+	MatchedFiles []string
+	// ChangedFiles are all files reported by the diff command
+	ChangedFiles []string
+	// Branch is the branch being built
+	Branch string
+	// Commit is the commit being built
+	Commit string
+	// DiffBase is the commit the diff was taken against, if known
+	DiffBase string
+	// Dir is the matched directory of a fan-out copy, e.g. "services/api"
+	Dir string
+	// Name is the last element of Dir, e.g. "api"
+	Name string
+}
+
+// stepRenderer renders templated strings of a step, remembering the first
+// error so that callers can render every field and check once at the end.
+type stepRenderer struct {
+	data interface{}
+	err  error
+}
+
+// renderStep returns a copy of step with its string fields rendered as Go
+// templates against data. Maps and slices holding rendered values are copied
+// so the original step, which may be shared, is left untouched.
+func renderStep(step Step, data interface{}) (Step, error) {
+	r := &stepRenderer{data: data}
+	rendered := r.step(step, "")
+
+	return rendered, r.err
+}
+
+func (r *stepRenderer) step(s Step, prefix string) Step {
+	s.Label = r.string(prefix+"label", s.Label)
+	s.Group = r.string(prefix+"group", s.Group)
+	s.Key = r.string(prefix+"key", s.Key)
+	s.Trigger = r.string(prefix+"trigger", s.Trigger)
+	s.Command = r.value(prefix+"command", s.Command)
+	s.Commands = r.value(prefix+"commands", s.Commands)
+	s.DependsOn = r.value(prefix+"depends_on", s.DependsOn)
+	s.Env = r.stringMap(prefix+"env", s.Env, s.EnvFromOS)
+
+	// the default build message is the commit message, which is not ours
+	// to interpret as a template
+	if !s.Build.DefaultMessage {
+		s.Build.Message = r.string(prefix+"build.message", s.Build.Message)
+	}
+
+	s.Build.Env = r.stringMap(prefix+"build.env", s.Build.Env, s.Build.EnvFromOS)
+	s.Build.Metadata = r.stringMap(prefix+"build.meta_data", s.Build.Metadata, nil)
+
+	if s.ArtifactPaths != nil {
+		paths := make([]string, len(s.ArtifactPaths))
+		for i, p := range s.ArtifactPaths {
+			paths[i] = r.string(fmt.Sprintf("%sartifact_paths[%d]", prefix, i), p)
+		}
+		s.ArtifactPaths = paths
+	}
+
+	if s.Steps != nil {
+		nested := make([]Step, len(s.Steps))
+		for i, n := range s.Steps {
+			nested[i] = r.step(n, fmt.Sprintf("%ssteps[%d].", prefix, i))
+		}
+		s.Steps = nested
+	}
+
+	return s
+}
+
+// value renders strings nested in the generic values decoded from JSON,
+// such as a command list or a depends_on entry.
+func (r *stepRenderer) value(field string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return r.string(field, v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = r.value(fmt.Sprintf("%s[%d]", field, i), item)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = r.value(field+"."+k, item)
+		}
+		return out
+	}
+
+	return v
+}
+
+// stringMap renders the values of m, except those of the keys in
+// passthrough, such as env values read from the agent's environment
+func (r *stepRenderer) stringMap(field string, m map[string]string, passthrough map[string]bool) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		if passthrough[k] {
+			out[k] = v
+			continue
+		}
+		out[k] = r.string(field+"."+k, v)
+	}
+
+	return out
+}
+
+func (r *stepRenderer) string(field, s string) string {
+	if r.err != nil || !strings.Contains(s, "{{") {
+		return s
+	}
+
+	rendered, err := renderString(field, s, r.data)
+	if err != nil {
+		r.err = err
+		return s
+	}
+
+	return rendered
+}
+
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// buildkiteMatrixRef matches Buildkite's own {{matrix}} interpolation, which
+// is left for Buildkite to replace
+var buildkiteMatrixRef = regexp.MustCompile(`\{\{\s*matrix(\.[\w-]+)?\s*\}\}`)
+
+// renderString executes s as a Go template named after the field it came from.
+func renderString(field, s string, data interface{}) (string, error) {
+	s = buildkiteMatrixRef.ReplaceAllStringFunc(s, func(ref string) string {
+		return fmt.Sprintf("{{%q}}", ref)
+	})
+
+	tmpl, err := template.New(field).Funcs(templateFuncs).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template in %s: %v", field, err)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to render template in %s: %v", field, err)
+	}
+
+	return out.String(), nil
+}
+
+// renderSteps renders each of steps against data
+func renderSteps(steps []Step, data interface{}) ([]Step, error) {
+	rendered := make([]Step, len(steps))
+	for i, step := range steps {
+		var err error
+		if rendered[i], err = renderStep(step, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return rendered, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderStep(t *testing.T) {
+	step := Step{
+		Label:    "Deploy {{.Watch}}",
+		Key:      "deploy-{{.Watch}}",
+		Commands: []interface{}{"echo {{.Branch}}", "lint {{join .MatchedFiles \" \"}}"},
+		Env:      map[string]string{"BASE": "{{.DiffBase}}", "PLAIN": "value"},
+		Steps: []Step{{
+			Trigger: "{{.Watch}}-pipeline",
+			Build:   Build{Message: "Changes since {{.DiffBase}}", Env: map[string]string{"COMMIT": "{{.Commit}}"}},
+		}},
+	}
+
+	data := templateData{
+		Watch:        "api",
+		MatchedFiles: []string{"api/a.go", "api/b.go"},
+		Branch:       "main",
+		Commit:       "abc123",
+		DiffBase:     "def456",
+	}
+
+	got, err := renderStep(step, data)
+	require.NoError(t, err)
+
+	assert.Equal(t, Step{
+		Label:    "Deploy api",
+		Key:      "deploy-api",
+		Commands: []interface{}{"echo main", "lint api/a.go api/b.go"},
+		Env:      map[string]string{"BASE": "def456", "PLAIN": "value"},
+		Steps: []Step{{
+			Trigger: "api-pipeline",
+			Build:   Build{Message: "Changes since def456", Env: map[string]string{"COMMIT": "abc123"}},
+		}},
+	}, got)
+
+	assert.Equal(t, "{{.DiffBase}}", step.Env["BASE"])
+	assert.Equal(t, "{{.Watch}}-pipeline", step.Steps[0].Trigger)
+}
+
+func TestRenderStepLeavesDefaultBuildMessage(t *testing.T) {
+	t.Setenv("BUILDKITE_MESSAGE", "chore: bump {{ version }}")
+
+	step := Step{Trigger: "deploy"}
+	setBuild(&step.Build)
+
+	got, err := renderStep(step, templateData{})
+	require.NoError(t, err)
+	assert.Equal(t, "chore: bump {{ version }}", got.Build.Message)
+}
+
+func TestRenderStepRendersConfiguredBuildMessage(t *testing.T) {
+	t.Setenv("BUILDKITE_MESSAGE", "Deploy {{.Watch}}")
+
+	step := Step{Trigger: "deploy", Build: Build{Message: "Deploy {{.Watch}}"}}
+	setBuild(&step.Build)
+
+	got, err := renderStep(step, templateData{Watch: "api"})
+	require.NoError(t, err)
+	assert.Equal(t, "Deploy api", got.Build.Message)
+}
+
+func TestRenderStepPassesEnvFromOSThrough(t *testing.T) {
+	t.Setenv("DEPLOY_NOTE", "ship {{ it }}")
+	t.Setenv("RELEASE_NOTE", "release {{ it }}")
+
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"templates": true,
+			"env": ["RELEASE_NOTE"],
+			"watch": [{
+				"path": "services/",
+				"config": {
+					"trigger": "deploy",
+					"env": { "DEPLOY_NOTE": null, "WATCH": "{{.Watch}}" },
+					"build": { "env": ["DEPLOY_NOTE", "TARGET={{.Watch}}"] }
+				}
+			}]
+		}
+	}]`
+
+	plugin, err := initializePlugin(param)
+	require.NoError(t, err)
+
+	got, err := renderStep(plugin.Watch[0].Steps[0], templateData{Watch: "services"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"DEPLOY_NOTE": "ship {{ it }}",
+		"WATCH":       "services",
+	}, got.Env)
+	assert.Equal(t, map[string]string{
+		"DEPLOY_NOTE":  "ship {{ it }}",
+		"RELEASE_NOTE": "release {{ it }}",
+		"TARGET":       "services",
+	}, got.Build.Env)
+}
+
+func TestRenderStepErrorNamesField(t *testing.T) {
+	step := Step{
+		Group: "checks",
+		Steps: []Step{{Command: "echo {{.Missing}}"}},
+	}
+
+	_, err := renderStep(step, templateData{})
+	assert.ErrorContains(t, err, "failed to render template in steps[0].command")
+}
+
+func TestStepsToTriggerRendersTemplates(t *testing.T) {
+	t.Setenv("BUILDKITE_BRANCH", "feature")
+
+	plugin := Plugin{
+		Templates: true,
+		DiffBase:  "abc123",
+		Watch: []WatchConfig{
+			{
+				Name:  "api",
+				Paths: []string{"api/"},
+				Steps: []Step{{Command: "lint {{join .MatchedFiles \" \"}} on {{.Branch}} since {{.DiffBase}}"}},
+			},
+			{
+				Paths: []string{"web/"},
+				Steps: []Step{{Command: "echo {{.Watch}} {{.ChangedFiles}}"}},
+			},
+		},
+	}
+
+	steps, err := stepsToTrigger([]string{"api/a.go", "web/b.ts"}, plugin)
+	require.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Command: "lint api/a.go on feature since abc123"},
+		{Command: "echo  [api/a.go web/b.ts]"},
+	}, steps)
+}
+
+func TestStepsToTriggerTemplatesAreOptIn(t *testing.T) {
+	plugin := Plugin{
+		Watch: []WatchConfig{{
+			Paths: []string{"api/"},
+			Steps: []Step{{Command: "echo {{.Watch}}"}},
+		}},
+	}
+
+	steps, err := stepsToTrigger([]string{"api/a.go"}, plugin)
+	require.NoError(t, err)
+	assert.Equal(t, []Step{{Command: "echo {{.Watch}}"}}, steps)
+}
+
+func TestStepsToTriggerTemplateErrorReportsWatch(t *testing.T) {
+	plugin := Plugin{
+		Templates: true,
+		Watch: []WatchConfig{
+			{Paths: []string{"web/"}, Steps: []Step{{Command: "echo web"}}},
+			{Name: "api", Paths: []string{"api/"}, Steps: []Step{{Label: "{{.Nope}}", Command: "echo api"}}},
+		},
+	}
+
+	_, err := stepsToTrigger([]string{"api/a.go"}, plugin)
+	assert.ErrorContains(t, err, "watch api: failed to render template in label")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported output values
+const (
+	outputAgent  = "agent"
+	outputStdout = "stdout"
+	outputFile   = "file"
+	outputJSON   = "json"
+)
+
+// uploadBackoff is the wait before retrying a failed pipeline upload the
+// first time, doubling for each next retry
+const uploadBackoff = 2 * time.Second
+
+// Uploader sends a generated pipeline file to where it's run or kept
+type Uploader interface {
+	Upload(pipeline string) error
+}
+
+// newUploader returns the uploader selected by the output of plugin,
+// writing to out when the output is stdout or json without a path
+func newUploader(plugin Plugin, out io.Writer) Uploader {
+	switch plugin.Output {
+	case outputStdout:
+		return writerUploader{out: out}
+	case outputFile:
+		return fileUploader{path: plugin.OutputPath}
+	case outputJSON:
+		return jsonUploader{path: plugin.OutputPath, out: out}
+	default:
+		return agentUploader{
+			interpolation: plugin.Interpolation,
+			replace:       plugin.Replace,
+			rejectSecrets: plugin.RejectSecrets,
+			jwksFile:      plugin.JWKSFile,
+			jwksKeyID:     plugin.JWKSKeyID,
+			args:          plugin.UploadArgs,
+			retries:       plugin.UploadRetries,
+			backoff:       uploadBackoff,
+		}
+	}
+}
+
+// appendingUploader returns uploader for the pipelines uploaded after the
+// first of a split pipeline, which must add to the build rather than
+// replace the pipelines uploaded before them
+func appendingUploader(uploader Uploader) Uploader {
+	if u, ok := uploader.(agentUploader); ok {
+		u.replace = false
+		return u
+	}
+
+	return uploader
+}
+
+// agentUploader uploads pipelines to the build with buildkite-agent,
+// retrying failed uploads
+type agentUploader struct {
+	interpolation bool
+	replace       bool
+	rejectSecrets bool
+	jwksFile      string
+	jwksKeyID     string
+	// args are passed to the upload after the others
+	args    []string
+	retries int
+	backoff time.Duration
+}
+
+func (u agentUploader) Upload(pipeline string) error {
+	data, err := os.ReadFile(pipeline)
+	if err != nil {
+		return fmt.Errorf("could not read pipeline: %v", err)
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.JSONFormatter); ok {
+		log.WithFields(log.Fields{"phase": phaseUpload, "pipeline": string(data)}).Info("Generated Pipeline")
+	} else {
+		fmt.Printf("Generated Pipeline:\n%s\n", string(data))
+	}
+
+	args := []string{"pipeline", "upload", pipeline}
+
+	if !u.interpolation {
+		args = append(args, "--no-interpolation")
+	}
+	if u.replace {
+		args = append(args, "--replace")
+	}
+	if u.rejectSecrets {
+		args = append(args, "--reject-secrets")
+	}
+	if u.jwksFile != "" {
+		args = append(args, "--jwks-file", u.jwksFile)
+	}
+	if u.jwksKeyID != "" {
+		args = append(args, "--jwks-key-id", u.jwksKeyID)
+	}
+	args = append(args, u.args...)
+
+	return retry(u.retries+1, u.backoff, func() error {
+		_, err := executeCommand("buildkite-agent", args)
+		return err
+	})
+}
+
+// writerUploader writes pipelines as YAML to out
+type writerUploader struct {
+	out io.Writer
+}
+
+func (u writerUploader) Upload(pipeline string) error {
+	data, err := os.ReadFile(pipeline)
+	if err != nil {
+		return fmt.Errorf("could not read pipeline: %v", err)
+	}
+
+	_, err = u.out.Write(data)
+
+	return err
+}
+
+// fileUploader writes pipelines as YAML to a file, such as one kept as an
+// artifact
+type fileUploader struct {
+	path string
+}
+
+func (u fileUploader) Upload(pipeline string) error {
+	data, err := os.ReadFile(pipeline)
+	if err != nil {
+		return fmt.Errorf("could not read pipeline: %v", err)
+	}
+
+	if err := os.WriteFile(u.path, data, 0o644); err != nil {
+		return fmt.Errorf("could not write pipeline to %s: %v", u.path, err)
+	}
+
+	return nil
+}
+
+// jsonUploader writes pipelines as JSON to a file, or to out without a path
+type jsonUploader struct {
+	path string
+	out  io.Writer
+}
+
+func (u jsonUploader) Upload(pipeline string) error {
+	data, err := os.ReadFile(pipeline)
+	if err != nil {
+		return fmt.Errorf("could not read pipeline: %v", err)
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("could not convert pipeline to JSON: %v", err)
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not convert pipeline to JSON: %v", err)
+	}
+	b = append(b, '\n')
+
+	if u.path == "" {
+		_, err = u.out.Write(b)
+		return err
+	}
+
+	if err := os.WriteFile(u.path, b, 0o644); err != nil {
+		return fmt.Errorf("could not write pipeline to %s: %v", u.path, err)
+	}
+
+	return nil
+}
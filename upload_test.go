@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingUploader keeps the content of the pipelines it's given
+type recordingUploader struct {
+	pipelines []string
+}
+
+func (u *recordingUploader) Upload(pipeline string) error {
+	data, err := os.ReadFile(pipeline)
+	if err != nil {
+		return err
+	}
+	u.pipelines = append(u.pipelines, string(data))
+
+	return nil
+}
+
+func TestUploadPipelineWithUploader(t *testing.T) {
+	plugin := Plugin{
+		Diff:  "echo services/api/main.go",
+		Watch: []WatchConfig{{Name: "api", Paths: []string{"services/api/"}, Steps: []Step{{Command: "make api"}}}},
+	}
+
+	uploader := &recordingUploader{}
+	err := uploadPipeline(plugin, generatePipeline, uploader)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"steps:\n    - command: make api\n"}, uploader.pipelines)
+}
+
+func TestNewUploader(t *testing.T) {
+	out := &bytes.Buffer{}
+
+	assert.Equal(t, agentUploader{interpolation: true, backoff: uploadBackoff}, newUploader(Plugin{Interpolation: true}, out))
+	assert.Equal(t, agentUploader{backoff: uploadBackoff}, newUploader(Plugin{Output: outputAgent}, out))
+	assert.Equal(t, agentUploader{
+		replace:       true,
+		rejectSecrets: true,
+		jwksFile:      "jwks.json",
+		jwksKeyID:     "key",
+		args:          []string{"--dry-run"},
+		retries:       3,
+		backoff:       uploadBackoff,
+	}, newUploader(Plugin{Replace: true, RejectSecrets: true, JWKSFile: "jwks.json", JWKSKeyID: "key", UploadArgs: []string{"--dry-run"}, UploadRetries: 3}, out))
+	assert.Equal(t, writerUploader{out: out}, newUploader(Plugin{Output: outputStdout}, out))
+	assert.Equal(t, fileUploader{path: "pipeline.yml"}, newUploader(Plugin{Output: outputFile, OutputPath: "pipeline.yml"}, out))
+	assert.Equal(t, jsonUploader{out: out}, newUploader(Plugin{Output: outputJSON}, out))
+}
+
+func writePipeline(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "generated.yml")
+	require.NoError(t, os.WriteFile(path, []byte("steps:\n    - command: make api\n    - wait: null\n"), 0o644))
+
+	return path
+}
+
+func TestWriterUploader(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, writerUploader{out: &out}.Upload(writePipeline(t)))
+
+	assert.Equal(t, "steps:\n    - command: make api\n    - wait: null\n", out.String())
+}
+
+func TestFileUploader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pipeline.yml")
+	require.NoError(t, fileUploader{path: path}.Upload(writePipeline(t)))
+
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "steps:\n    - command: make api\n    - wait: null\n", string(got))
+}
+
+func TestJSONUploader(t *testing.T) {
+	want := `{
+  "steps": [
+    {
+      "command": "make api"
+    },
+    {
+      "wait": null
+    }
+  ]
+}
+`
+
+	var out bytes.Buffer
+	require.NoError(t, jsonUploader{out: &out}.Upload(writePipeline(t)))
+	assert.Equal(t, want, out.String())
+
+	path := filepath.Join(t.TempDir(), "pipeline.json")
+	require.NoError(t, jsonUploader{path: path}.Upload(writePipeline(t)))
+
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+}
+
+// mockAgent puts a mock buildkite-agent first in PATH
+func mockAgent(t *testing.T) *bintest.Mock {
+	t.Helper()
+
+	agent, err := bintest.NewMock("buildkite-agent")
+	require.NoError(t, err)
+
+	oldPath := os.Getenv("PATH")
+	t.Cleanup(func() { _ = os.Setenv("PATH", oldPath) })
+	_ = os.Setenv("PATH", filepath.Dir(agent.Path)+":"+oldPath)
+
+	return agent
+}
+
+func TestAgentUploaderWithOptions(t *testing.T) {
+	agent := mockAgent(t)
+	pipeline := writePipeline(t)
+
+	agent.
+		Expect("pipeline", "upload", pipeline, "--no-interpolation", "--replace", "--reject-secrets", "--jwks-file", "jwks.json", "--jwks-key-id", "key", "--dry-run").
+		AndExitWith(0)
+
+	u := agentUploader{
+		replace:       true,
+		rejectSecrets: true,
+		jwksFile:      "jwks.json",
+		jwksKeyID:     "key",
+		args:          []string{"--dry-run"},
+	}
+	assert.NoError(t, u.Upload(pipeline))
+
+	require.NoError(t, agent.CheckAndClose(t))
+}
+
+func TestAgentUploaderRetries(t *testing.T) {
+	agent := mockAgent(t)
+	pipeline := writePipeline(t)
+
+	agent.Expect("pipeline", "upload", pipeline).AndExitWith(1)
+	agent.Expect("pipeline", "upload", pipeline).AndExitWith(1)
+	agent.Expect("pipeline", "upload", pipeline).AndExitWith(0)
+
+	u := agentUploader{interpolation: true, retries: 2, backoff: time.Millisecond}
+	assert.NoError(t, u.Upload(pipeline))
+
+	require.NoError(t, agent.CheckAndClose(t))
+}
+
+func TestAgentUploaderGivesUpAfterRetries(t *testing.T) {
+	agent := mockAgent(t)
+	pipeline := writePipeline(t)
+
+	agent.Expect("pipeline", "upload", pipeline).AndExitWith(1)
+	agent.Expect("pipeline", "upload", pipeline).AndExitWith(1)
+
+	u := agentUploader{interpolation: true, retries: 1, backoff: time.Millisecond}
+	assert.ErrorContains(t, u.Upload(pipeline), "command `buildkite-agent` failed")
+
+	require.NoError(t, agent.CheckAndClose(t))
+}
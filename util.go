@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -50,3 +51,44 @@ func isString(val interface{}) (string, bool) {
 
 	return "", false
 }
+
+// stringList returns a config value given as a string or a list of strings
+// as a list, or an error naming field when an entry isn't a string
+func stringList(field string, raw interface{}) ([]string, error) {
+	switch raw := raw.(type) {
+	case string:
+		return []string{raw}, nil
+	case []interface{}:
+		list := []string{}
+		for _, v := range raw {
+			s, ok := isString(v)
+			if !ok {
+				return nil, fmt.Errorf("%s entries must be strings, got %v", field, v)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+
+	return nil, nil
+}
+
+// retry calls fn up to attempts times until it succeeds, waiting backoff
+// before the first retry and twice as long before each next one. It
+// returns the last error.
+func retry(attempts int, backoff time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			log.Warnf("Attempt %d of %d failed: %v. Retrying in %s", i, attempts, err, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/dlclark/regexp2"
+	"gopkg.in/yaml.v3"
+)
+
+// hookFields are the plugin keys read by the hooks rather than the binary
+var hookFields = []string{"download", "verify_checksum", "binary_folder"}
+
+// problem is an issue found in a plugin config, at a line of the file
+type problem struct {
+	Line    int
+	Message string
+}
+
+// validator collects the problems found in the plugin configs of a pipeline
+type validator struct {
+	problems []problem
+	// keys are the step keys of the pipeline outside the plugin configs
+	keys map[string]bool
+}
+
+func (v *validator) add(node *yaml.Node, format string, args ...interface{}) {
+	v.problems = append(v.problems, problem{Line: node.Line, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateCommand reports the problems of the plugin configs of a pipeline
+// and fails when it finds any
+func validateCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	config := flags.String("config", ".buildkite/pipeline.yml", "pipeline or plugin config file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	problems, err := validateFile(*config)
+	if err != nil {
+		return err
+	}
+
+	if len(problems) == 0 {
+		fmt.Fprintf(out, "%s: no problems found\n", *config)
+		return nil
+	}
+
+	for _, p := range problems {
+		fmt.Fprintf(out, "%s:%d: %s\n", *config, p.Line, p.Message)
+	}
+
+	return withExitCode(exitConfig, fmt.Errorf("%d problems found in %s", len(problems), *config))
+}
+
+// validateFile returns the problems of the plugin configs in a pipeline
+// file, or a file holding just the plugin config, ordered by line
+func validateFile(path string) ([]problem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %v", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse config %s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("no %s plugin config found in %s", pluginName, path)
+	}
+
+	v := &validator{keys: map[string]bool{}}
+	configs := v.pluginNodes(doc.Content[0])
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no %s plugin config found in %s", pluginName, path)
+	}
+
+	for _, c := range configs {
+		v.validatePlugin(c[0], c[1])
+	}
+
+	sort.SliceStable(v.problems, func(i, j int) bool { return v.problems[i].Line < v.problems[j].Line })
+
+	return v.problems, nil
+}
+
+// pluginNodes returns the name and config nodes of the plugin in a pipeline,
+// recording the keys of the other steps. A document with a watch list is
+// taken to be the plugin config itself.
+func (v *validator) pluginNodes(doc *yaml.Node) [][2]*yaml.Node {
+	if doc.Kind == yaml.MappingNode {
+		if mappingValue(doc, "watch") != nil {
+			return [][2]*yaml.Node{{{Kind: yaml.ScalarNode, Value: pluginName}, doc}}
+		}
+		doc = mappingValue(doc, "steps")
+	}
+	if doc == nil || doc.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	configs := [][2]*yaml.Node{}
+	for _, step := range doc.Content {
+		if step.Kind != yaml.MappingNode {
+			continue
+		}
+
+		if key := mappingValue(step, "key"); key != nil {
+			v.keys[key.Value] = true
+		}
+
+		var plugins []*yaml.Node
+		switch p := mappingValue(step, "plugins"); {
+		case p == nil:
+		case p.Kind == yaml.SequenceNode:
+			plugins = p.Content
+		case p.Kind == yaml.MappingNode:
+			plugins = []*yaml.Node{p}
+		}
+
+		for _, p := range plugins {
+			if p.Kind != yaml.MappingNode {
+				continue
+			}
+			for i := 0; i+1 < len(p.Content); i += 2 {
+				if strings.HasPrefix(getPluginName(p.Content[i].Value), pluginName) {
+					configs = append(configs, [2]*yaml.Node{p.Content[i], p.Content[i+1]})
+				}
+			}
+		}
+
+		// group steps hold their own steps
+		configs = append(configs, v.pluginNodes(&yaml.Node{
+			Kind:    yaml.MappingNode,
+			Content: []*yaml.Node{{Kind: yaml.ScalarNode, Value: "steps"}, mappingValue(step, "steps")},
+		})...)
+	}
+
+	return configs
+}
+
+// validatePlugin records the problems of a plugin config
+func (v *validator) validatePlugin(name, config *yaml.Node) {
+	if config.Kind != yaml.MappingNode {
+		v.add(config, "plugin config must be a map")
+		return
+	}
+
+	v.checkKeys(config, jsonFields(reflect.TypeOf(Plugin{})), hookFields, "plugin")
+
+	watchNodes := []*yaml.Node{}
+	if watch := mappingValue(config, "watch"); watch != nil && watch.Kind == yaml.SequenceNode {
+		watchNodes = watch.Content
+	}
+	for _, w := range watchNodes {
+		if w.Kind == yaml.MappingNode {
+			v.checkKeys(w, jsonFields(reflect.TypeOf(WatchConfig{})), nil, "watch")
+		}
+	}
+
+	plugin, err := decodePlugin(name.Value, config)
+	if err != nil {
+		v.add(config, "%v", err)
+		return
+	}
+	if len(plugin.Watch) != len(watchNodes) {
+		return
+	}
+
+	for _, p := range scalars(mappingValue(config, "ignore_uncovered")) {
+		v.checkPattern(p, false)
+	}
+
+	stepKeys := map[string]*yaml.Node{}
+	for i, w := range plugin.Watch {
+		node := watchNodes[i]
+
+		for _, field := range []string{"path", "skip_path", "except_path"} {
+			for _, p := range scalars(mappingValue(node, field)) {
+				v.checkPattern(p, w.RegexPaths)
+			}
+		}
+
+		v.checkCoverage(w, node)
+
+		if w.Key != "" {
+			v.checkKey(w.Key, mappingValue(node, "key"), stepKeys, plugin)
+		}
+
+		if w.hasPaths() && len(w.Steps) == 0 {
+			v.add(node, "watch %s has no config, it generates no steps", w.Name)
+		}
+
+		v.checkSteps(w.Steps, configNodes(node), node, stepKeys, plugin)
+	}
+
+	known := v.knownKeys(plugin)
+	for i, w := range plugin.Watch {
+		v.checkDependsOn(w.DependsOn, mappingValue(watchNodes[i], "depends_on"), watchNodes[i], known)
+		v.checkStepDependencies(w.Steps, configNodes(watchNodes[i]), watchNodes[i], known)
+	}
+}
+
+// decodePlugin parses a plugin config node the way the plugin parses its
+// configuration
+func decodePlugin(name string, config *yaml.Node) (Plugin, error) {
+	var raw interface{}
+	if err := config.Decode(&raw); err != nil {
+		return Plugin{}, err
+	}
+
+	b, err := json.Marshal([]map[string]interface{}{{name: raw}})
+	if err != nil {
+		return Plugin{}, err
+	}
+
+	return initializePlugin(string(b))
+}
+
+// checkKeys records the keys of a mapping that the plugin ignores
+func (v *validator) checkKeys(node *yaml.Node, fields map[string]bool, extra []string, kind string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		name := strings.ToLower(key.Value)
+		if !fields[name] && !slices.Contains(extra, name) {
+			v.add(key, "unknown %s key %q", kind, key.Value)
+		}
+	}
+}
+
+// checkPattern records a path pattern that doesn't compile
+func (v *validator) checkPattern(node *yaml.Node, useRegex bool) {
+	p := node.Value
+	if useRegex {
+		if _, err := regexp2.Compile(p, 0); err != nil {
+			v.add(node, "invalid regex %q: %v", p, err)
+		}
+		return
+	}
+
+	if strings.Contains(p, "*") && !doublestar.ValidatePattern(p) {
+		v.add(node, "invalid glob %q", p)
+	}
+}
+
+// checkCoverage records a watch whose every path is covered by its skip or
+// except paths, so it can never generate steps
+func (v *validator) checkCoverage(w WatchConfig, node *yaml.Node) {
+	if !w.hasPaths() || len(w.Paths) == 0 {
+		return
+	}
+
+	fields := []struct {
+		name     string
+		patterns []string
+	}{
+		{"skip_path", w.SkipPaths},
+		{"except_path", w.ExceptPaths},
+	}
+
+	for _, f := range fields {
+		covered := true
+		for _, p := range w.Paths {
+			if !slices.ContainsFunc(f.patterns, func(c string) bool { return covers(c, p, w.RegexPaths) }) {
+				covered = false
+				break
+			}
+		}
+
+		if covered {
+			// keys are matched case-insensitively, so the node may be
+			// spelled differently
+			at := mappingValue(node, f.name)
+			if at == nil {
+				at = node
+			}
+			v.add(at, "watch %s can never match: %s covers every path", w.Name, f.name)
+		}
+	}
+}
+
+// covers reports whether every file matching path also matches pattern
+func covers(pattern, path string, useRegex bool) bool {
+	if pattern == path || useRegex {
+		return pattern == path
+	}
+
+	if !strings.Contains(pattern, "*") {
+		return strings.HasPrefix(path, pattern)
+	}
+
+	for _, suffix := range []string{"**/*", "**"} {
+		if prefix, ok := strings.CutSuffix(pattern, suffix); ok && !strings.Contains(prefix, "*") {
+			return strings.HasPrefix(path, prefix)
+		}
+	}
+
+	return false
+}
+
+// checkSteps records the steps the plugin would skip as invalid and the
+// step keys used more than once. nodes are the config nodes of steps, when
+// they line up, and parent the node to report other problems at.
+func (v *validator) checkSteps(steps []Step, nodes []*yaml.Node, parent *yaml.Node, keys map[string]*yaml.Node, plugin Plugin) {
+	if len(nodes) != len(steps) {
+		nodes = nil
+	}
+
+	for i, step := range steps {
+		node := parent
+		if nodes != nil {
+			node = nodes[i]
+		}
+
+		if !step.isValid() {
+			v.add(node, "invalid step, it will be skipped: %s", invalidStepReason(step))
+		}
+
+		if step.Key != "" {
+			v.checkKey(step.Key, mappingValue(node, "key"), keys, plugin)
+		}
+
+		v.checkSteps(step.Steps, sequence(mappingValue(node, "steps")), node, keys, plugin)
+	}
+}
+
+// checkKey records a step key used by an earlier step
+func (v *validator) checkKey(key string, node *yaml.Node, keys map[string]*yaml.Node, plugin Plugin) {
+	// templated keys and keys merged by duplicate_steps may repeat
+	merged := plugin.DuplicateSteps == duplicateFirstWins || plugin.DuplicateSteps == duplicateMerge
+	if strings.Contains(key, "{{") || merged || node == nil {
+		return
+	}
+
+	if first, ok := keys[key]; ok {
+		v.add(node, "step key %q is already used on line %d", key, first.Line)
+		return
+	}
+	keys[key] = node
+}
+
+// knownKeys returns the keys steps can depend on: those of the pipeline,
+// of the steps and watches of the plugin, and those generated for after
+func (v *validator) knownKeys(plugin Plugin) map[string]bool {
+	known := map[string]bool{}
+	for key := range v.keys {
+		known[key] = true
+	}
+
+	var collect func(steps []Step)
+	collect = func(steps []Step) {
+		for _, s := range steps {
+			if s.Key != "" {
+				known[s.Key] = true
+			}
+			collect(s.Steps)
+		}
+	}
+
+	for _, w := range plugin.Watch {
+		if w.Key != "" {
+			known[w.Key] = true
+		}
+		collect(w.Steps)
+
+		if w.Name != "" && isReferenced(w.Name, plugin.Watch) {
+			for n := 1; n <= len(w.Steps); n++ {
+				known[watchStepKey(w.Name, n)] = true
+			}
+		}
+	}
+
+	return known
+}
+
+// checkStepDependencies records the depends_on entries of steps that refer
+// to no step
+func (v *validator) checkStepDependencies(steps []Step, nodes []*yaml.Node, parent *yaml.Node, known map[string]bool) {
+	if len(nodes) != len(steps) {
+		nodes = nil
+	}
+
+	for i, step := range steps {
+		node := parent
+		if nodes != nil {
+			node = nodes[i]
+		}
+
+		v.checkDependsOn(step.DependsOn, mappingValue(node, "depends_on"), node, known)
+		v.checkStepDependencies(step.Steps, sequence(mappingValue(node, "steps")), node, known)
+	}
+}
+
+// checkDependsOn records the entries of a depends_on value that refer to
+// no known key
+func (v *validator) checkDependsOn(dependsOn interface{}, node, parent *yaml.Node, known map[string]bool) {
+	if node == nil {
+		node = parent
+	}
+
+	for _, d := range dependsOnList(dependsOn) {
+		key := dependencyKey(d)
+		if key == "" || strings.Contains(key, "{{") || known[key] {
+			continue
+		}
+		v.add(node, "depends_on refers to unknown step %q", key)
+	}
+}
+
+// configNodes returns the nodes of the steps configured for a watch
+func configNodes(watch *yaml.Node) []*yaml.Node {
+	config := mappingValue(watch, "config")
+	for _, field := range []string{"default", "always", "uncovered"} {
+		if config != nil {
+			break
+		}
+		if shorthand := mappingValue(watch, field); shorthand != nil {
+			config = mappingValue(shorthand, "config")
+			if config == nil {
+				config = shorthand
+			}
+		}
+	}
+
+	if config != nil && config.Kind == yaml.MappingNode {
+		return []*yaml.Node{config}
+	}
+
+	return sequence(config)
+}
+
+// mappingValue returns the value of key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// sequence returns the items of a sequence node, or nil
+func sequence(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	return node.Content
+}
+
+// scalars returns a scalar node, or the scalar items of a sequence node
+func scalars(node *yaml.Node) []*yaml.Node {
+	if node == nil {
+		return nil
+	}
+	if node.Kind == yaml.ScalarNode {
+		return []*yaml.Node{node}
+	}
+
+	items := []*yaml.Node{}
+	for _, n := range sequence(node) {
+		if n.Kind == yaml.ScalarNode {
+			items = append(items, n)
+		}
+	}
+
+	return items
+}
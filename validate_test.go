@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "pipeline.yml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	return path
+}
+
+func TestValidateFile(t *testing.T) {
+	path := writeConfig(t, `steps:
+  - key: lint
+    command: make lint
+  - label: "Triggering pipelines"
+    plugins:
+      - monorepo-diff#v1.0.0:
+          diff: "git diff --name-only HEAD~1"
+          wiat: true
+          watch:
+            - path: "services/api/"
+              skip_path: "services/"
+              config:
+                command: make api
+            - path: "services/web/[a-*"
+              config:
+                - key: web
+                  command: make web
+                  depends_on: [lint, build]
+                - label: nothing to run
+            - path: "services/worker/"
+              config:
+                key: web
+                command: make worker
+`)
+
+	problems, err := validateFile(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, []problem{
+		{Line: 8, Message: `unknown plugin key "wiat"`},
+		{Line: 11, Message: `watch services-api can never match: skip_path covers every path`},
+		{Line: 14, Message: `invalid glob "services/web/[a-*"`},
+		{Line: 18, Message: `depends_on refers to unknown step "build"`},
+		{Line: 19, Message: `invalid step, it will be skipped: step with label 'nothing to run' has no command, trigger, block, input, or group`},
+		{Line: 22, Message: `step key "web" is already used on line 16`},
+	}, problems)
+}
+
+func TestValidateFileRegexPaths(t *testing.T) {
+	path := writeConfig(t, `watch:
+  - path: "services/(api|web"
+    regex_paths: true
+    config:
+      command: make
+  - path: "lib/"
+    except_path: ["lib/", "docs/"]
+    config:
+      command: make lib
+`)
+
+	problems, err := validateFile(path)
+	require.NoError(t, err)
+
+	require.Len(t, problems, 2)
+	assert.Equal(t, 2, problems[0].Line)
+	assert.Contains(t, problems[0].Message, `invalid regex "services/(api|web"`)
+	assert.Equal(t, problem{Line: 7, Message: `watch lib can never match: except_path covers every path`}, problems[1])
+}
+
+func TestValidateFileKnownDependencies(t *testing.T) {
+	path := writeConfig(t, `watch:
+  - name: api
+    path: services/api/
+    config:
+      - command: make api
+      - command: make api-docs
+  - path: services/web/
+    after: api
+    config:
+      command: make web
+      depends_on:
+        - step: api-2
+  - path: services/worker/
+    config:
+      command: make worker
+      depends_on: "{{ .Watch }}"
+`)
+
+	problems, err := validateFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestValidateFileParseError(t *testing.T) {
+	path := writeConfig(t, `watch:
+  - path: services/api/
+    for_each: file
+    config:
+      command: make api
+`)
+
+	problems, err := validateFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []problem{{Line: 1, Message: `unsupported for_each value "file", expected "matched_dir"`}}, problems)
+}
+
+func TestValidateCommand(t *testing.T) {
+	valid := writeConfig(t, `watch:
+  - path: services/api/
+    config:
+      command: make api
+`)
+
+	var out bytes.Buffer
+	require.NoError(t, runCommand([]string{"validate", "--config", valid}, &out))
+	assert.Equal(t, valid+": no problems found\n", out.String())
+
+	invalid := writeConfig(t, `watch:
+  - path: services/api/
+`)
+
+	out.Reset()
+	err := runCommand([]string{"validate", "--config", invalid}, &out)
+	assert.EqualError(t, err, "1 problems found in "+invalid)
+	assert.Equal(t, invalid+":2: watch services-api has no config, it generates no steps\n", out.String())
+}
+
+func TestValidateFileWithoutPlugin(t *testing.T) {
+	path := writeConfig(t, `steps:
+  - command: make
+`)
+
+	_, err := validateFile(path)
+	assert.EqualError(t, err, "no monorepo-diff plugin config found in "+path)
+}
+
+func TestValidateFileDuplicateStepsError(t *testing.T) {
+	config := `duplicate_steps: %s
+watch:
+  - path: services/api/
+    config:
+      key: deploy
+      command: make deploy-api
+  - path: services/web/
+    config:
+      key: deploy
+      command: make deploy-web
+`
+
+	problems, err := validateFile(writeConfig(t, fmt.Sprintf(config, duplicateError)))
+	require.NoError(t, err)
+	assert.Equal(t, []problem{{Line: 9, Message: `step key "deploy" is already used on line 5`}}, problems)
+
+	problems, err = validateFile(writeConfig(t, fmt.Sprintf(config, duplicateMerge)))
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestValidateFileWatchAttributesOnGroups(t *testing.T) {
+	path := writeConfig(t, `group_by: watch
+watch:
+  - path: services/api/
+    key: api
+    if: build.branch == "main"
+    config:
+      - group: API
+        steps:
+          - command: make deploy
+      - command: make smoke-test
+`)
+
+	problems, err := validateFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []problem{{Line: 1, Message: "watch services-api: key, depends_on and if only apply to a config of a single group, as groups can't be nested"}}, problems)
+}
+
+func TestValidateFileUnknownKeys(t *testing.T) {
+	path := writeConfig(t, `diff: git diff --name-only HEAD~1
+watch:
+  - path: services/api/
+    steps:
+      - command: make api
+    config:
+      command: make api
+`)
+
+	problems, err := validateFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []problem{{Line: 4, Message: `unknown watch key "steps"`}}, problems)
+}
+
+func TestValidateFileCoverageWithDifferentlySpelledKey(t *testing.T) {
+	path := writeConfig(t, `watch:
+  - path: services/api/
+    Except_Path: services/
+    config:
+      command: make api
+`)
+
+	problems, err := validateFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []problem{{Line: 2, Message: "watch services-api can never match: except_path covers every path"}}, problems)
+}
+
+func TestValidateFileValueOfWrongType(t *testing.T) {
+	path := writeConfig(t, `watch:
+  - path: services/api/
+    after: [1]
+    config:
+      command: make api
+`)
+
+	problems, err := validateFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []problem{{Line: 1, Message: "after entries must be strings, got 1"}}, problems)
+}